@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	context "context"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/yndc/kvrpc/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// anyName matches every database or namespace in the access rules
+const anyName = "*"
+
+// accessControl holds the access rules of the principals. Requests are only
+// allowed when one of the rules of their principal grants the operation,
+// admin tokens and requests served without authentication are not checked.
+type accessControl struct {
+	mu    sync.RWMutex
+	rules map[string]*pb.PrincipalRules
+}
+
+func newAccessControl() *accessControl {
+	return &accessControl{
+		rules: make(map[string]*pb.PrincipalRules),
+	}
+}
+
+func accessKey(principal string) []byte {
+	return reservedKey("acl", principal)
+}
+
+// load reads the access rules from the database
+func (a *accessControl) load(d *database) error {
+	prefix := reservedKey("acl")
+	if !d.iterable(prefix) {
+		return nil
+	}
+	return d.db.View(func(txn *badger.Txn) error {
+		opt := badger.DefaultIteratorOptions
+		opt.Prefix = prefix
+		it := txn.NewIterator(opt)
+		defer it.Close()
+
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		for it.Rewind(); it.Valid(); it.Next() {
+			rules := &pb.PrincipalRules{}
+			err := it.Item().Value(func(val []byte) error {
+				return proto.Unmarshal(val, rules)
+			})
+			if err != nil {
+				return err
+			}
+			a.rules[rules.Principal] = rules
+		}
+		return nil
+	})
+}
+
+// allowed checks whether any of the rules of the principal grants op. The
+// key is matched against the prefix of the rules unless anyKey is set.
+func (a *accessControl) allowed(p *principal, op pb.Operation, database, namespace string, key []byte, anyKey bool) bool {
+	if database == "" {
+		database = defaultDatabase
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, name := range p.names() {
+		if rules, ok := a.rules[name]; ok && allows(rules, op, database, namespace, key, anyKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// visible checks whether any of the rules of the principal covers the
+// namespace of the database, anyName matches the rules of every namespace
+func (a *accessControl) visible(p *principal, database, namespace string) bool {
+	if database == "" {
+		database = defaultDatabase
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, name := range p.names() {
+		rules, ok := a.rules[name]
+		if !ok {
+			continue
+		}
+		for _, rule := range rules.Rules {
+			if covers(rule, database, namespace) || (namespace == anyName && covers(rule, database, rule.Namespace)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// covers checks whether the rule applies to the namespace of the database
+func covers(rule *pb.AccessRule, database, namespace string) bool {
+	ruleDatabase := rule.Database
+	if ruleDatabase == "" {
+		ruleDatabase = defaultDatabase
+	}
+	if ruleDatabase != anyName && ruleDatabase != database {
+		return false
+	}
+	return rule.Namespace == anyName || rule.Namespace == namespace
+}
+
+// allows checks whether any of the rules grants op
+func allows(rules *pb.PrincipalRules, op pb.Operation, database, namespace string, key []byte, anyKey bool) bool {
+	for _, rule := range rules.Rules {
+		if !covers(rule, database, namespace) {
+			continue
+		}
+		if !anyKey && !bytes.HasPrefix(key, rule.Prefix) {
+			continue
+		}
+		for _, o := range rule.Operations {
+			if o == op {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func operationName(op pb.Operation) string {
+	return strings.ToLower(op.String())
+}
+
+// authorizeKeys checks that the caller is allowed to run op on every key
+func (s *Service) authorizeKeys(ctx context.Context, op pb.Operation, database, namespace string, keys [][]byte) error {
+	p := principalFrom(ctx)
+	if p == nil || p.admin {
+		return nil
+	}
+	for i, key := range keys {
+		if !s.acl.allowed(p, op, database, namespace, key, false) {
+			return keyStatusf(codes.PermissionDenied, i, "%q is not allowed to %s key %d", p.id, operationName(op), i)
+		}
+	}
+	return nil
+}
+
+// authorizePrefix checks that the caller is allowed to run op on every key
+// with the prefix
+func (s *Service) authorizePrefix(ctx context.Context, op pb.Operation, database, namespace string, prefix []byte) error {
+	p := principalFrom(ctx)
+	if p == nil || p.admin {
+		return nil
+	}
+	if !s.acl.allowed(p, op, database, namespace, prefix, false) {
+		return status.Errorf(codes.PermissionDenied, "%q is not allowed to %s prefix %q", p.id, operationName(op), prefix)
+	}
+	return nil
+}
+
+// authorizeAdmin checks that the caller is allowed to manage the namespace of
+// the database, anyName is only matched by the rules for every namespace
+func (s *Service) authorizeAdmin(ctx context.Context, database, namespace string) error {
+	p := principalFrom(ctx)
+	if p == nil || p.admin {
+		return nil
+	}
+	if !s.acl.allowed(p, pb.Operation_ADMIN, database, namespace, nil, true) {
+		return status.Errorf(codes.PermissionDenied, "%q is not allowed to administer database %q", p.id, database)
+	}
+	return nil
+}
+
+// listable reports whether the caller sees the namespace of the database in
+// the listings, which is when any of its rules covers it
+func (s *Service) listable(ctx context.Context, database, namespace string) bool {
+	p := principalFrom(ctx)
+	return p == nil || p.admin || s.acl.visible(p, database, namespace)
+}
+
+// requireAdmin rejects the callers without an admin token, every caller is an
+// admin when authentication is disabled
+func requireAdmin(ctx context.Context, action string) error {
+	if p := principalFrom(ctx); p != nil && !p.admin {
+		return status.Errorf(codes.PermissionDenied, "%s requires an admin token", action)
+	}
+	return nil
+}
+
+func validateRule(i int, rule *pb.AccessRule) error {
+	if rule.Database != "" && rule.Database != anyName && !namePattern.MatchString(rule.Database) {
+		return status.Errorf(codes.InvalidArgument, "rule %d has an invalid database %q", i, rule.Database)
+	}
+	if rule.Namespace != "" && rule.Namespace != anyName && !namePattern.MatchString(rule.Namespace) {
+		return status.Errorf(codes.InvalidArgument, "rule %d has an invalid namespace %q", i, rule.Namespace)
+	}
+	if len(rule.Operations) == 0 {
+		return status.Errorf(codes.InvalidArgument, "rule %d has no operations", i)
+	}
+	for _, op := range rule.Operations {
+		if _, ok := pb.Operation_name[int32(op)]; !ok {
+			return status.Errorf(codes.InvalidArgument, "rule %d has an unknown operation %d", i, op)
+		}
+	}
+	return nil
+}
+
+// SetAccessRules replaces the access rules of a principal, they're stored in
+// the default database
+func (s *Service) SetAccessRules(ctx context.Context, in *pb.PrincipalRules) (*pb.Empty, error) {
+	if err := requireAdmin(ctx, "setting access rules"); err != nil {
+		return nil, err
+	}
+	if in.Principal == "" {
+		return nil, status.Error(codes.InvalidArgument, "principal must not be empty")
+	}
+	for i, rule := range in.Rules {
+		if err := validateRule(i, rule); err != nil {
+			return nil, err
+		}
+	}
+	d, release, err := s.database(defaultDatabase)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if err := d.writable(); err != nil {
+		return nil, err
+	}
+	val, err := proto.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+
+	s.acl.mu.Lock()
+	defer s.acl.mu.Unlock()
+	err = d.db.Update(func(txn *badger.Txn) error {
+		if len(in.Rules) == 0 {
+			return txn.Delete(accessKey(in.Principal))
+		}
+		return txn.Set(accessKey(in.Principal), val)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(in.Rules) == 0 {
+		delete(s.acl.rules, in.Principal)
+	} else {
+		s.acl.rules[in.Principal] = in
+	}
+	return &pb.Empty{}, nil
+}
+
+// ListAccessRules returns the access rules sorted by principal
+func (s *Service) ListAccessRules(ctx context.Context, in *pb.ListAccessRulesRequest) (*pb.ListAccessRulesResponse, error) {
+	if err := requireAdmin(ctx, "listing access rules"); err != nil {
+		return nil, err
+	}
+	s.acl.mu.RLock()
+	principals := make([]*pb.PrincipalRules, 0, len(s.acl.rules))
+	for name, rules := range s.acl.rules {
+		if in.Principal == "" || in.Principal == name {
+			principals = append(principals, rules)
+		}
+	}
+	s.acl.mu.RUnlock()
+
+	sort.Slice(principals, func(i, j int) bool {
+		return principals[i].Principal < principals[j].Principal
+	})
+	return &pb.ListAccessRulesResponse{
+		Principals: principals,
+	}, nil
+}
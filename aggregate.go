@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	context "context"
+	"encoding/binary"
+	"math"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/yndc/kvrpc/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// aggregateThreads is the number of goroutines iterating over the ranges of an
+// aggregation
+const aggregateThreads = 16
+
+// aggregation is the partial result of the reducers over a part of the keyspace
+type aggregation struct {
+	count      uint64
+	sum        int64
+	min        int64
+	max        int64
+	int64Count uint64
+	sizes      [65]uint64
+	prefixes   map[string]struct{}
+}
+
+func newAggregation() *aggregation {
+	return &aggregation{
+		min:      math.MaxInt64,
+		max:      math.MinInt64,
+		prefixes: make(map[string]struct{}),
+	}
+}
+
+func (a *aggregation) merge(other *aggregation) {
+	a.count += other.count
+	a.sum += other.sum
+	a.int64Count += other.int64Count
+	if other.min < a.min {
+		a.min = other.min
+	}
+	if other.max > a.max {
+		a.max = other.max
+	}
+	for i, c := range other.sizes {
+		a.sizes[i] += c
+	}
+	for p := range other.prefixes {
+		a.prefixes[p] = struct{}{}
+	}
+}
+
+func (a *aggregation) response(reducers map[pb.Reducer]bool) *pb.AggregateResponse {
+	res := &pb.AggregateResponse{
+		Count: a.count,
+	}
+	if reducers[pb.Reducer_SUM_INT64] || reducers[pb.Reducer_MIN_MAX_INT64] {
+		res.Int64Count = a.int64Count
+	}
+	if reducers[pb.Reducer_SUM_INT64] {
+		res.Sum = a.sum
+	}
+	if reducers[pb.Reducer_MIN_MAX_INT64] && a.int64Count > 0 {
+		res.Min = a.min
+		res.Max = a.max
+	}
+	if reducers[pb.Reducer_SIZE_HISTOGRAM] {
+		last := 0
+		for i, c := range a.sizes {
+			if c > 0 {
+				last = i
+			}
+		}
+		res.SizeHistogram = make([]*pb.SizeBucket, last+1)
+		for i := range res.SizeHistogram {
+			res.SizeHistogram[i] = &pb.SizeBucket{
+				Le:    1<<uint(i) - 1,
+				Count: a.sizes[i],
+			}
+		}
+	}
+	if reducers[pb.Reducer_DISTINCT_PREFIX] {
+		res.DistinctPrefixes = uint64(len(a.prefixes))
+	}
+	return res
+}
+
+// Aggregate runs the requested reducers over the matching entries in parallel
+// and returns a single summary
+func (s *Service) Aggregate(ctx context.Context, in *pb.AggregateRequest) (*pb.AggregateResponse, error) {
+	if err := s.authorizePrefix(ctx, pb.Operation_READ, in.Database, in.Namespace, in.Prefix); err != nil {
+		return nil, err
+	}
+	d, ks, release, err := s.keyspace(in.Database, in.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if ks.reserved(in.Prefix) {
+		return nil, status.Error(codes.InvalidArgument, "prefix is inside the reserved keyspace")
+	}
+	f, err := compileFilter(in.Filter)
+	if err != nil {
+		return nil, err
+	}
+	reducers := make(map[pb.Reducer]bool)
+	for _, r := range in.Reducers {
+		if _, ok := pb.Reducer_name[int32(r)]; !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "unknown reducer %d", r)
+		}
+		reducers[r] = true
+	}
+	delimiter := in.Delimiter
+	if len(delimiter) == 0 {
+		delimiter = []byte("/")
+	}
+	readValues := f.needsValue() || reducers[pb.Reducer_SUM_INT64] || reducers[pb.Reducer_MIN_MAX_INT64]
+
+	partials := make([]*aggregation, aggregateThreads)
+	for i := range partials {
+		partials[i] = newAggregation()
+	}
+
+	prefix := ks.key(in.Prefix)
+	if d.iterable(prefix) {
+		err = d.view(ctx, func(txn *badger.Txn) error {
+			return aggregateRanges(ctx, txn, d.db.KeySplits(prefix), prefix, func(thread int, it *badger.Iterator) error {
+				item := it.Item()
+				if ks.reserved(item.Key()) {
+					it.Seek(reservedEnd)
+					return nil
+				}
+				defer it.Next()
+				key := item.Key()[len(ks.prefix):]
+				size := uint64(item.ValueSize())
+				if !f.matchKey(key, size) {
+					return nil
+				}
+				var val []byte
+				if readValues {
+					var err error
+					if val, err = item.ValueCopy(nil); err != nil {
+						return err
+					}
+				}
+				if !f.matchValue(val) {
+					return nil
+				}
+
+				a := partials[thread]
+				a.count++
+				a.sizes[bits.Len64(size)]++
+				if len(val) == 8 {
+					n := int64(binary.BigEndian.Uint64(val))
+					a.int64Count++
+					a.sum += n
+					if n < a.min {
+						a.min = n
+					}
+					if n > a.max {
+						a.max = n
+					}
+				}
+				if reducers[pb.Reducer_DISTINCT_PREFIX] {
+					rest := key[len(in.Prefix):]
+					if i := bytes.Index(rest, delimiter); i >= 0 {
+						rest = rest[:i]
+					}
+					a.prefixes[string(rest)] = struct{}{}
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := newAggregation()
+	for _, a := range partials {
+		result.merge(a)
+	}
+	return result.response(reducers), nil
+}
+
+// aggregateRanges splits the prefix at the given keys and iterates over the
+// ranges with aggregateThreads goroutines, fn is called on each entry and must
+// move the iterator forward. The iteration stops at the first error of fn or
+// once ctx is done, which is checked before every entry.
+func aggregateRanges(ctx context.Context, txn *badger.Txn, splits []string, prefix []byte, fn func(thread int, it *badger.Iterator) error) error {
+	ranges := make(chan [2][]byte, len(splits)+1)
+	left := prefix
+	for _, split := range splits {
+		// the splits are internal keys, which end with the 8 bytes version
+		right := []byte(split[:len(split)-8])
+		if bytes.Compare(right, left) > 0 {
+			ranges <- [2][]byte{left, right}
+			left = right
+		}
+	}
+	ranges <- [2][]byte{left, nil}
+	close(ranges)
+
+	var failedOnce sync.Once
+	var failed error
+	var aborted int32
+	fail := func(err error) {
+		failedOnce.Do(func() { failed = err })
+		atomic.StoreInt32(&aborted, 1)
+	}
+	iterate := func(thread int, r [2][]byte) error {
+		opt := badger.DefaultIteratorOptions
+		opt.Prefix = prefix
+		opt.PrefetchValues = false
+		it := txn.NewIterator(opt)
+		defer it.Close()
+		for it.Seek(r[0]); it.Valid(); {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if atomic.LoadInt32(&aborted) != 0 {
+				return nil
+			}
+			if r[1] != nil && bytes.Compare(it.Item().Key(), r[1]) >= 0 {
+				return nil
+			}
+			if err := fn(thread, it); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < aggregateThreads; i++ {
+		wg.Add(1)
+		go func(thread int) {
+			defer wg.Done()
+			for r := range ranges {
+				if atomic.LoadInt32(&aborted) != 0 {
+					return
+				}
+				if err := iterate(thread, r); err != nil {
+					fail(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	return failed
+}
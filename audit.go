@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	context "context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/rs/zerolog/log"
+	"github.com/yndc/kvrpc/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// redactedSuffix replaces the rest of the keys with a redacted prefix
+const redactedSuffix = "[redacted]"
+
+// auditConfig is the configuration of the audit log
+type auditConfig struct {
+	file     string
+	maxSize  int64
+	maxFiles int
+	// redact is the prefixes of the keys which are written without the rest
+	// of the key
+	redact []string
+}
+
+// auditRecord is a line of the audit log
+type auditRecord struct {
+	Time       time.Time `json:"time"`
+	Method     string    `json:"method"`
+	Principal  string    `json:"principal,omitempty"`
+	Peer       string    `json:"peer,omitempty"`
+	Database   string    `json:"database,omitempty"`
+	Namespace  string    `json:"namespace,omitempty"`
+	Target     string    `json:"target,omitempty"`
+	Keys       []string  `json:"keys,omitempty"`
+	ValueSizes []int     `json:"value_sizes,omitempty"`
+	RequestID  string    `json:"request_id,omitempty"`
+	Code       string    `json:"code"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// auditLog writes a JSON line for every mutating call into a file, which is
+// rotated once it reaches the maximum size. The rotated files are suffixed
+// with .1 for the newest up to the maximum number of files.
+type auditLog struct {
+	config auditConfig
+
+	mu sync.Mutex
+	// file is nil after a failed rotation until it's opened again
+	file   *os.File
+	size   int64
+	closed bool
+}
+
+func newAuditLog(config auditConfig) (*auditLog, error) {
+	a := &auditLog{config: config}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *auditLog) open() error {
+	f, err := os.OpenFile(a.config.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file, a.size = f, info.Size()
+	return nil
+}
+
+// rotate shifts the rotated files, dropping the oldest, and starts a new file.
+// The file is opened again when the rotation fails, so the records keep being
+// written to it.
+func (a *auditLog) rotate() error {
+	err := a.file.Close()
+	a.file = nil
+	if err != nil {
+		return a.reopen(err)
+	}
+	rotated := func(i int) string {
+		return fmt.Sprintf("%s.%d", a.config.file, i)
+	}
+	os.Remove(rotated(a.config.maxFiles))
+	for i := a.config.maxFiles - 1; i >= 1; i-- {
+		if err := os.Rename(rotated(i), rotated(i+1)); err != nil && !os.IsNotExist(err) {
+			return a.reopen(err)
+		}
+	}
+	if err := os.Rename(a.config.file, rotated(1)); err != nil {
+		return a.reopen(err)
+	}
+	return a.open()
+}
+
+// reopen opens the file again after the rotation failed with err
+func (a *auditLog) reopen(err error) error {
+	if openErr := a.open(); openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+// write appends the record, it's written even when the rotation failed as
+// long as the file could be opened again
+func (a *auditLog) write(record *auditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return os.ErrClosed
+	}
+	if a.file == nil {
+		if err := a.open(); err != nil {
+			return err
+		}
+	}
+	var rotateErr error
+	if a.size > 0 && a.size+int64(len(line)) > a.config.maxSize {
+		rotateErr = a.rotate()
+		if a.file == nil {
+			return rotateErr
+		}
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return rotateErr
+}
+
+func (a *auditLog) close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.closed = true
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
+
+// key formats a key for the log, the keys which aren't valid UTF-8 are
+// written in base64
+func (a *auditLog) key(key []byte) string {
+	for _, prefix := range a.config.redact {
+		if bytes.HasPrefix(key, []byte(prefix)) {
+			return prefix + redactedSuffix
+		}
+	}
+	if utf8.Valid(key) {
+		return string(key)
+	}
+	return "base64:" + base64.StdEncoding.EncodeToString(key)
+}
+
+// record describes the call, it's nil for the calls which don't mutate
+func (a *auditLog) record(req interface{}) *auditRecord {
+	r := &auditRecord{}
+	switch in := req.(type) {
+	case *pb.SetRequest:
+		r.Database, r.Namespace, r.RequestID = in.Database, in.Namespace, in.RequestId
+		for _, v := range in.Values {
+			r.Keys = append(r.Keys, a.key(v.Key))
+			r.ValueSizes = append(r.ValueSizes, len(v.Value))
+		}
+	case *pb.DelRequest:
+		r.Database, r.Namespace, r.RequestID = in.Database, in.Namespace, in.RequestId
+		for _, k := range in.Keys {
+			r.Keys = append(r.Keys, a.key(k))
+		}
+	case *pb.CreateBucketRequest:
+		r.Database, r.Namespace, r.RequestID = in.Database, in.Name, in.RequestId
+	case *pb.DropBucketRequest:
+		r.Database, r.Namespace, r.RequestID = in.Database, in.Name, in.RequestId
+	case *pb.OpenDatabaseRequest:
+		r.Database = in.Name
+	case *pb.CloseDatabaseRequest:
+		r.Database = in.Name
+	case *pb.RevokeTokenRequest:
+		r.Target = in.Id
+	case *pb.PrincipalRules:
+		r.Target = in.Principal
+	case *pb.Quota:
+		r.Database, r.Namespace = in.Database, in.Namespace
+	default:
+		return nil
+	}
+	if r.Database == "" {
+		r.Database = defaultDatabase
+	}
+	return r
+}
+
+// auditUnary writes the mutating calls into the audit log once they're done
+func (s *Service) auditUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if s.audit == nil {
+		return handler(ctx, req)
+	}
+	record := s.audit.record(req)
+	if record == nil {
+		return handler(ctx, req)
+	}
+	record.Time = time.Now().UTC()
+	record.Method = info.FullMethod
+	if p := principalFrom(ctx); p != nil {
+		record.Principal = p.id
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		record.Peer = p.Addr.String()
+	}
+
+	res, err := handler(ctx, req)
+	st := status.Convert(statusError(err))
+	record.Code = st.Code().String()
+	if err != nil {
+		record.Error = st.Message()
+	}
+	if err := s.audit.write(record); err != nil {
+		s.metrics.auditFailed()
+		log.Error().Err(err).Str("method", info.FullMethod).Msg("failed to write the audit log")
+	}
+	return res, err
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/yndc/kvrpc/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+)
+
+func TestAudit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvrpc-audit-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := defaultConfig()
+	config.inMemory = true
+	config.loglevel = "error"
+	config.audit.file = filepath.Join(dir, "audit.log")
+	config.audit.redact = []string{"secret/"}
+	service := NewService(config)
+	defer service.Close()
+
+	ctx := withPrincipal(context.Background(), &principal{id: "billing"})
+	ctx = peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}})
+	call := func(method string, req interface{}, handler func(ctx context.Context, req interface{}) (interface{}, error)) {
+		info := &grpc.UnaryServerInfo{FullMethod: "/pb.KVRPC/" + method}
+		service.auditUnary(ctx, req, info, handler)
+	}
+	call("Set", &pb.SetRequest{Namespace: "team", RequestId: "r1", Values: []*pb.KeyValue{
+		{Key: []byte("a"), Value: []byte("123")},
+		{Key: []byte("secret/password"), Value: []byte("hunter2")},
+		{Key: []byte{0xff, 0x00}, Value: nil},
+	}}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return &pb.SetResponse{}, nil
+	})
+	call("Get", &pb.GetRequest{Keys: [][]byte{[]byte("a")}}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return &pb.GetResponse{}, nil
+	})
+	call("Del", &pb.DelRequest{Keys: [][]byte{nil}}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return service.Del(ctx, req.(*pb.DelRequest))
+	})
+
+	f, err := os.Open(config.audit.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []auditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected the mutating calls only, got %+v", records)
+	}
+
+	set := records[0]
+	if set.Method != "/pb.KVRPC/Set" || set.Principal != "billing" || set.Peer != "10.0.0.1:5000" ||
+		set.Database != defaultDatabase || set.Namespace != "team" || set.RequestID != "r1" || set.Code != "OK" || set.Time.IsZero() {
+		t.Errorf("unexpected record %+v", set)
+	}
+	expectedKeys := []string{"a", "secret/" + redactedSuffix, "base64:/wA="}
+	if len(set.Keys) != 3 || len(set.ValueSizes) != 3 || set.ValueSizes[1] != 7 {
+		t.Fatalf("unexpected keys %v and sizes %v", set.Keys, set.ValueSizes)
+	}
+	for i, key := range expectedKeys {
+		if set.Keys[i] != key {
+			t.Errorf("expected key %d to be logged as %q, got %q", i, key, set.Keys[i])
+		}
+	}
+	if del := records[1]; del.Code != "PermissionDenied" || del.Error != `"billing" is not allowed to delete key 0` {
+		t.Errorf("expected the rejection to be recorded, got %+v", del)
+	}
+}
+
+func TestAuditRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvrpc-audit-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "audit.log")
+	a, err := newAuditLog(auditConfig{file: file, maxSize: 200, maxFiles: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.close()
+	for i := 0; i < 10; i++ {
+		if err := a.write(&auditRecord{Method: "/pb.KVRPC/Set", Keys: []string{"key"}, Code: "OK"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{file, file + ".1", file + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 200 {
+			t.Errorf("expected %s to be rotated at 200 bytes, got %d", name, info.Size())
+		}
+	}
+	if _, err := os.Stat(file + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only 2 rotated files to be kept, got %v", err)
+	}
+}
+
+func TestAuditRotationFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvrpc-audit-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "audit.log")
+	a, err := newAuditLog(auditConfig{file: file, maxSize: 100, maxFiles: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.close()
+	record := &auditRecord{Method: "/pb.KVRPC/Set", Keys: []string{"key"}, Code: "OK"}
+	if err := a.write(record); err != nil {
+		t.Fatal(err)
+	}
+
+	// a directory in the way of the rotated file fails the rotation, the
+	// records keep being written to the file
+	if err := os.MkdirAll(filepath.Join(file+".1", "blocked"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.write(record); err == nil {
+		t.Fatal("expected the rotation to fail")
+	}
+	lines := func(name string) int {
+		content, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Count(string(content), "\n")
+	}
+	if n := lines(file); n != 2 {
+		t.Errorf("expected the record to be written despite the failed rotation, got %d lines", n)
+	}
+
+	if err := os.RemoveAll(file + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.write(record); err != nil {
+		t.Fatalf("expected the rotation to recover, got %v", err)
+	}
+	if n := lines(file + ".1"); n != 2 {
+		t.Errorf("expected the file to be rotated, got %d lines", n)
+	}
+	if n := lines(file); n != 1 {
+		t.Errorf("expected a new file to be started, got %d lines", n)
+	}
+}
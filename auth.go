@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	context "context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+	"sync"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/yndc/kvrpc/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// healthMethodPrefix is the prefix of the health service methods, they're
+// served without a token so probes don't need one
+const healthMethodPrefix = "/grpc.health.v1.Health/"
+
+// tokenConfig is a token accepted by the server. Tokens are given by clients
+// as <id>.<secret> and only the hex SHA-256 hash of the secret is configured.
+type tokenConfig struct {
+	id    string
+	hash  string
+	admin bool
+}
+
+// principal is the authenticated caller of a request, the groups and the
+// tenant are only set for JWTs
+type principal struct {
+	id     string
+	admin  bool
+	groups []string
+	// tenant binds the requests into the namespace of the tenant
+	tenant string
+}
+
+// jwtPrincipalPrefix is the prefix of the ids of the principals authenticated
+// with a JWT, followed by their subject. Token ids can't contain a colon.
+const jwtPrincipalPrefix = "jwt:"
+
+// names returns the names the access rules of the principal are looked up
+// with, the groups are prefixed with "group:"
+func (p *principal) names() []string {
+	names := []string{p.id}
+	for _, g := range p.groups {
+		names = append(names, "group:"+g)
+	}
+	return names
+}
+
+type principalKey struct{}
+
+func withPrincipal(ctx context.Context, p *principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// principalFrom returns the caller of the request, it's nil when
+// authentication is disabled
+func principalFrom(ctx context.Context) *principal {
+	p, _ := ctx.Value(principalKey{}).(*principal)
+	return p
+}
+
+// tokenStore checks the tokens given by the clients against the configured
+// ones, authentication is disabled when there are none
+type tokenStore struct {
+	tokens map[string]tokenConfig
+
+	mu      sync.RWMutex
+	revoked map[string]bool
+}
+
+func newTokenStore(tokens []tokenConfig) *tokenStore {
+	t := &tokenStore{
+		tokens:  make(map[string]tokenConfig),
+		revoked: make(map[string]bool),
+	}
+	for _, token := range tokens {
+		t.tokens[token.id] = token
+	}
+	return t
+}
+
+func (t *tokenStore) enabled() bool {
+	return len(t.tokens) > 0
+}
+
+func revokedKey(id string) []byte {
+	return reservedKey("revoked", id)
+}
+
+// load reads the revoked tokens from the database
+func (t *tokenStore) load(d *database) error {
+	prefix := reservedKey("revoked")
+	if !d.iterable(prefix) {
+		return nil
+	}
+	return d.db.View(func(txn *badger.Txn) error {
+		opt := badger.DefaultIteratorOptions
+		opt.Prefix = prefix
+		opt.PrefetchValues = false
+		it := txn.NewIterator(opt)
+		defer it.Close()
+
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		for it.Rewind(); it.Valid(); it.Next() {
+			id := bytes.TrimSuffix(it.Item().Key()[len(prefix):], []byte{0})
+			t.revoked[string(id)] = true
+		}
+		return nil
+	})
+}
+
+// authenticate returns the principal of a token
+func (t *tokenStore) authenticate(token string) (*principal, error) {
+	dot := strings.Index(token, ".")
+	if dot < 0 {
+		return nil, status.Error(codes.Unauthenticated, "malformed token")
+	}
+	id, secret := token[:dot], token[dot+1:]
+	config, ok := t.tokens[id]
+	hash := sha256.Sum256([]byte(secret))
+	expected, _ := hex.DecodeString(config.hash)
+	if !ok || subtle.ConstantTimeCompare(hash[:], expected) != 1 {
+		return nil, status.Error(codes.Unauthenticated, "invalid token")
+	}
+
+	t.mu.RLock()
+	revoked := t.revoked[id]
+	t.mu.RUnlock()
+	if revoked {
+		return nil, status.Errorf(codes.Unauthenticated, "token %q has been revoked", id)
+	}
+	return &principal{id: id, admin: config.admin}, nil
+}
+
+// tokenFromMetadata reads the token from the authorization header as a bearer
+// token or from the x-api-key header
+func tokenFromMetadata(md metadata.MD) string {
+	for _, v := range md.Get("authorization") {
+		if len(v) > 7 && strings.EqualFold(v[:7], "bearer ") {
+			return strings.TrimSpace(v[7:])
+		}
+	}
+	if v := md.Get("x-api-key"); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// authenticate attaches the principal of the token given in the request
+// metadata into ctx
+func (s *Service) authenticate(ctx context.Context, method string) (context.Context, error) {
+	if (!s.tokens.enabled() && s.jwt == nil) || strings.HasPrefix(method, healthMethodPrefix) {
+		return ctx, nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	token := tokenFromMetadata(md)
+	if token == "" {
+		return nil, status.Error(codes.Unauthenticated, "missing token")
+	}
+	var p *principal
+	var err error
+	if s.jwt != nil && isJWT(token) {
+		p, err = s.jwt.verify(token)
+	} else {
+		p, err = s.tokens.authenticate(token)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return withPrincipal(ctx, p), nil
+}
+
+// authenticateUnary rejects the unary requests without a valid token
+func (s *Service) authenticateUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := s.authenticate(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	if p := principalFrom(ctx); p != nil && p.tenant != "" {
+		if err := bindTenant(req, p.tenant); err != nil {
+			return nil, err
+		}
+	}
+	return handler(ctx, req)
+}
+
+// bindTenant sets the namespace of the request to the tenant, requests for
+// other namespaces are denied. The bucket requests carry the namespace in
+// their name.
+func bindTenant(req interface{}, tenant string) error {
+	var err error
+	switch in := req.(type) {
+	case *pb.CreateBucketRequest:
+		in.Name, err = tenantNamespace(in.Name, tenant)
+		return err
+	case *pb.DropBucketRequest:
+		in.Name, err = tenantNamespace(in.Name, tenant)
+		return err
+	}
+	m, ok := req.(proto.Message)
+	if !ok {
+		return nil
+	}
+	msg := m.ProtoReflect()
+	field := msg.Descriptor().Fields().ByName("namespace")
+	if field == nil || field.Kind() != protoreflect.StringKind {
+		return nil
+	}
+	namespace, err := tenantNamespace(msg.Get(field).String(), tenant)
+	if err != nil {
+		return err
+	}
+	msg.Set(field, protoreflect.ValueOfString(namespace))
+	return nil
+}
+
+// tenantNamespace returns the namespace of a request of the tenant
+func tenantNamespace(namespace, tenant string) (string, error) {
+	if namespace != "" && namespace != tenant {
+		return "", status.Errorf(codes.PermissionDenied, "namespace %q is outside of the tenant", namespace)
+	}
+	return tenant, nil
+}
+
+// authenticateStream rejects the streams without a valid token
+func (s *Service) authenticateStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.authenticate(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authenticatedStream{ServerStream: ss, ctx: ctx})
+}
+
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// RevokeToken rejects a token from now on, the revocation is stored in the
+// default database so it outlives restarts
+func (s *Service) RevokeToken(ctx context.Context, in *pb.RevokeTokenRequest) (*pb.Empty, error) {
+	if err := requireAdmin(ctx, "revoking tokens"); err != nil {
+		return nil, err
+	}
+	if _, ok := s.tokens.tokens[in.Id]; !ok {
+		return nil, status.Errorf(codes.NotFound, "token %q does not exist", in.Id)
+	}
+	d, release, err := s.database(defaultDatabase)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if err := d.writable(); err != nil {
+		return nil, err
+	}
+
+	err = d.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(revokedKey(in.Id), nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.tokens.mu.Lock()
+	s.tokens.revoked[in.Id] = true
+	s.tokens.mu.Unlock()
+	return &pb.Empty{}, nil
+}
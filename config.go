@@ -1,36 +1,1070 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/dgraph-io/badger/v3/options"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
+// envPrefix is the prefix of the environment variables read as configuration
+const envPrefix = "KVRPC_"
+
 type config struct {
-	port     int
-	path     string
-	loglevel string
+	port             int
+	path             string
+	inMemory         bool
+	readOnly         bool
+	loglevel         string
+	databases        []databaseConfig
+	requestRetention time.Duration
+	healthInterval   time.Duration
+	drainDelay       time.Duration
+	shutdownTimeout  time.Duration
+	metricsAddress   string
+	traceFile        string
+	traceEndpoint    string
+	traceSampleRatio float64
+	audit            auditConfig
+	slowThreshold    time.Duration
+	slowBufferSize   int
+	maxMessageSize   int64
+	maxBatchKeys     int
+	maxKeySize       int
+	maxValueSize     int64
+	tlsCert          string
+	tlsKey           string
+	tlsClientCA      string
+	tokens           []tokenConfig
+	jwt              jwtConfig
+	limits           []limitConfig
+	deadlines        map[string]time.Duration
+	badger           badgerOptions
+
+	// unknownEnv is the environment variables with the prefix which aren't
+	// settings, they're logged and ignored
+	unknownEnv []string
 }
 
-func loadConfig() *config {
-	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
-	port := flag.Int("p", 9000, "port to listen for requests")
-	if port == nil {
-		log.Fatal().Msg("port is invalid")
+func defaultConfig() *config {
+	return &config{
+		port:             9000,
+		path:             "./data",
+		loglevel:         "warn",
+		requestRetention: defaultRequestRetention,
+		healthInterval:   defaultHealthInterval,
+		shutdownTimeout:  defaultShutdownTimeout,
+		traceSampleRatio: 1,
+		slowThreshold:    time.Second,
+		slowBufferSize:   100,
+		audit: auditConfig{
+			maxSize:  100 << 20,
+			maxFiles: 10,
+		},
+		maxMessageSize: 1_000_000_000,
+		maxKeySize:     badgerMaxKeySize,
+		badger:         defaultBadgerOptions(),
+		jwt: jwtConfig{
+			subjectClaim: "sub",
+			groupsClaim:  "groups",
+		},
+	}
+}
+
+// option is a setting which can be given in the config file, as an environment
+// variable and as a command line flag, in increasing order of precedence
+type option struct {
+	// name is the key in the config file, the environment variable is the
+	// upper cased name with the KVRPC_ prefix
+	name  string
+	flag  string
+	usage string
+	// boolean flags can be given without a value
+	boolean bool
+	// set parses the value given in the environment or the flag, the config
+	// file values are given to set as well unless decode is defined
+	set    func(c *config, value string) error
+	decode func(c *config, raw json.RawMessage) error
+	// reset clears list options, so a source with higher precedence replaces
+	// the list instead of extending it
+	reset func(c *config)
+}
+
+func (o *option) env() string {
+	return envPrefix + strings.ToUpper(o.name)
+}
+
+var configOptions = []*option{
+	{
+		name:  "port",
+		flag:  "p",
+		usage: "port to listen for requests",
+		set:   intOption(func(c *config) *int { return &c.port }),
+	},
+	{
+		name:  "path",
+		flag:  "d",
+		usage: "the directory path used for the database",
+		set:   stringOption(func(c *config) *string { return &c.path }),
+	},
+	{
+		name:    "in_memory",
+		flag:    "memory",
+		usage:   "keep the default database in memory only, the path is ignored",
+		boolean: true,
+		set:     boolOption(func(c *config) *bool { return &c.inMemory }),
+	},
+	{
+		name:    "read_only",
+		flag:    "read-only",
+		usage:   "open every database read-only and reject the mutating requests",
+		boolean: true,
+		set:     boolOption(func(c *config) *bool { return &c.readOnly }),
+	},
+	{
+		name:  "log_level",
+		flag:  "l",
+		usage: "logging level (debug | info | warn | error)",
+		set:   stringOption(func(c *config) *string { return &c.loglevel }),
+	},
+	{
+		name:   "databases",
+		flag:   "db",
+		usage:  "additional database to serve as name=path[,sync][,memory], can be repeated or separated with ;",
+		set:    setDatabases,
+		decode: decodeDatabases,
+		reset:  func(c *config) { c.databases = nil },
+	},
+	{
+		name:  "request_retention",
+		flag:  "request-retention",
+		usage: "how long the responses of requests with an id are kept to detect retries",
+		set:   durationOption(func(c *config) *time.Duration { return &c.requestRetention }),
+	},
+	{
+		name:  "health_interval",
+		flag:  "health-interval",
+		usage: "interval of the database health checks",
+		set:   durationOption(func(c *config) *time.Duration { return &c.healthInterval }),
+	},
+	{
+		name:  "drain_delay",
+		flag:  "drain-delay",
+		usage: "how long the server keeps serving after reporting not serving on shutdown",
+		set:   durationOption(func(c *config) *time.Duration { return &c.drainDelay }),
+	},
+	{
+		name:  "shutdown_timeout",
+		flag:  "shutdown-timeout",
+		usage: "how long the calls in flight are waited for on shutdown",
+		set:   durationOption(func(c *config) *time.Duration { return &c.shutdownTimeout }),
+	},
+	{
+		name:  "max_message_size",
+		flag:  "max-message-size",
+		usage: "maximum size of a request message",
+		set:   sizeOption(func(c *config) *int64 { return &c.maxMessageSize }),
+	},
+	{
+		name:  "max_batch_keys",
+		flag:  "max-batch-keys",
+		usage: "maximum number of keys in a request, 0 for no limit",
+		set:   intOption(func(c *config) *int { return &c.maxBatchKeys }),
+	},
+	{
+		name:  "max_key_size",
+		flag:  "max-key-size",
+		usage: "maximum size of a key in bytes, at most 65000",
+		set:   intOption(func(c *config) *int { return &c.maxKeySize }),
+	},
+	{
+		name:  "max_value_size",
+		flag:  "max-value-size",
+		usage: "maximum size of a value, 0 for the value log file size",
+		set:   sizeOption(func(c *config) *int64 { return &c.maxValueSize }),
+	},
+	{
+		name:  "metrics_address",
+		flag:  "metrics-addr",
+		usage: "address to serve the Prometheus metrics at /metrics over HTTP, such as :9100",
+		set:   stringOption(func(c *config) *string { return &c.metricsAddress }),
+	},
+	{
+		name:  "trace_file",
+		flag:  "trace-file",
+		usage: "file to append the spans of the calls to as OTLP JSON, one batch per line",
+		set:   stringOption(func(c *config) *string { return &c.traceFile }),
+	},
+	{
+		name:  "trace_endpoint",
+		flag:  "trace-endpoint",
+		usage: "OTLP/HTTP traces endpoint to export the spans of the calls to, such as http://localhost:4318/v1/traces",
+		set:   stringOption(func(c *config) *string { return &c.traceEndpoint }),
+	},
+	{
+		name:  "trace_sample_ratio",
+		flag:  "trace-sample-ratio",
+		usage: "ratio of the calls traced when the caller didn't decide",
+		set:   floatOption(func(c *config) *float64 { return &c.traceSampleRatio }),
+	},
+	{
+		name:  "audit_file",
+		flag:  "audit-file",
+		usage: "file to write a JSON line into for every mutating call",
+		set:   stringOption(func(c *config) *string { return &c.audit.file }),
+	},
+	{
+		name:  "audit_max_size",
+		flag:  "audit-max-size",
+		usage: "size the audit log is rotated at",
+		set:   sizeOption(func(c *config) *int64 { return &c.audit.maxSize }),
+	},
+	{
+		name:  "audit_max_files",
+		flag:  "audit-max-files",
+		usage: "number of rotated audit logs kept",
+		set:   intOption(func(c *config) *int { return &c.audit.maxFiles }),
+	},
+	{
+		name:   "audit_redact",
+		flag:   "audit-redact",
+		usage:  "prefix of the keys written into the audit log without the rest of the key, can be repeated or separated with ;",
+		set:    setAuditRedact,
+		decode: decodeAuditRedact,
+		reset:  func(c *config) { c.audit.redact = nil },
+	},
+	{
+		name:  "slow_request_threshold",
+		flag:  "slow-request-threshold",
+		usage: "duration of the calls logged as slow, 0 to disable",
+		set:   durationOption(func(c *config) *time.Duration { return &c.slowThreshold }),
+	},
+	{
+		name:  "slow_request_buffer",
+		flag:  "slow-request-buffer",
+		usage: "number of recent slow calls kept for ListSlowRequests",
+		set:   intOption(func(c *config) *int { return &c.slowBufferSize }),
+	},
+	{
+		name:  "tls_cert",
+		flag:  "tls-cert",
+		usage: "PEM certificate file to serve TLS with, reloaded when it changes",
+		set:   stringOption(func(c *config) *string { return &c.tlsCert }),
+	},
+	{
+		name:  "tls_key",
+		flag:  "tls-key",
+		usage: "PEM private key file of the TLS certificate",
+		set:   stringOption(func(c *config) *string { return &c.tlsKey }),
+	},
+	{
+		name:  "tls_client_ca",
+		flag:  "tls-client-ca",
+		usage: "PEM CA bundle to require and verify client certificates with",
+		set:   stringOption(func(c *config) *string { return &c.tlsClientCA }),
+	},
+	{
+		name:   "tokens",
+		flag:   "token",
+		usage:  "token accepted from the clients as id=sha256[,admin] with the hex SHA-256 of the secret, can be repeated or separated with ;",
+		set:    setTokens,
+		decode: decodeTokens,
+		reset:  func(c *config) { c.tokens = nil },
+	},
+	{
+		name:  "jwt_jwks",
+		flag:  "jwt-jwks",
+		usage: "JWKS file with the keys to verify JWTs with, reloaded when it changes",
+		set:   stringOption(func(c *config) *string { return &c.jwt.jwks }),
+	},
+	{
+		name:  "jwt_audience",
+		flag:  "jwt-audience",
+		usage: "audience the JWTs must be issued for",
+		set:   stringOption(func(c *config) *string { return &c.jwt.audience }),
+	},
+	{
+		name:  "jwt_issuer",
+		flag:  "jwt-issuer",
+		usage: "issuer the JWTs must be issued by, any issuer when empty",
+		set:   stringOption(func(c *config) *string { return &c.jwt.issuer }),
+	},
+	{
+		name:  "jwt_subject_claim",
+		flag:  "jwt-subject-claim",
+		usage: "claim the principal is read from, nested claims are separated with dots",
+		set:   stringOption(func(c *config) *string { return &c.jwt.subjectClaim }),
+	},
+	{
+		name:  "jwt_groups_claim",
+		flag:  "jwt-groups-claim",
+		usage: "claim the groups are read from, access rules of a group are set for group:<name>",
+		set:   stringOption(func(c *config) *string { return &c.jwt.groupsClaim }),
+	},
+	{
+		name:  "jwt_tenant_claim",
+		flag:  "jwt-tenant-claim",
+		usage: "claim the tenant is read from, requests are bound into the namespace of the tenant",
+		set:   stringOption(func(c *config) *string { return &c.jwt.tenantClaim }),
+	},
+	{
+		name:  "jwt_admin_group",
+		flag:  "jwt-admin-group",
+		usage: "group whose members are admins",
+		set:   stringOption(func(c *config) *string { return &c.jwt.adminGroup }),
+	},
+	{
+		name:   "rate_limits",
+		flag:   "rate-limit",
+		usage:  "limit of the calls grouped by principal, peer or method as by[@method]=rate[,burst=N][,in_flight=N], can be repeated or separated with ;",
+		set:    setLimits,
+		decode: decodeLimits,
+		reset:  func(c *config) { c.limits = nil },
+	},
+	{
+		name:   "deadlines",
+		flag:   "deadline",
+		usage:  "default deadline of the calls without one as method=duration, * for every method, can be repeated or separated with ;",
+		set:    setDeadlines,
+		decode: decodeDeadlines,
+		reset:  func(c *config) { c.deadlines = nil },
+	},
+	{
+		name:    "sync_writes",
+		flag:    "sync-writes",
+		usage:   "sync every write to disk before acknowledging it",
+		boolean: true,
+		set:     boolOption(func(c *config) *bool { return &c.badger.syncWrites }),
+	},
+	{
+		name:  "mem_table_size",
+		flag:  "mem-table-size",
+		usage: "size of each Badger memtable, e.g. 64MB",
+		set:   sizeOption(func(c *config) *int64 { return &c.badger.memTableSize }),
+	},
+	{
+		name:  "value_threshold",
+		flag:  "value-threshold",
+		usage: "values larger than this are stored in the value log instead of the LSM tree",
+		set: func(c *config, value string) error {
+			n, err := parseSize(value)
+			if err != nil {
+				return err
+			}
+			c.badger.valueThreshold = int(n)
+			return nil
+		},
+	},
+	{
+		name:  "num_versions_to_keep",
+		flag:  "num-versions-to-keep",
+		usage: "number of versions kept for each key",
+		set:   intOption(func(c *config) *int { return &c.badger.numVersionsToKeep }),
+	},
+	{
+		name:  "block_cache_size",
+		flag:  "block-cache-size",
+		usage: "size of the block cache, 0 disables it",
+		set:   sizeOption(func(c *config) *int64 { return &c.badger.blockCacheSize }),
+	},
+	{
+		name:  "index_cache_size",
+		flag:  "index-cache-size",
+		usage: "size of the index cache, 0 keeps the indices in memory",
+		set:   sizeOption(func(c *config) *int64 { return &c.badger.indexCacheSize }),
+	},
+	{
+		name:  "compression",
+		flag:  "compression",
+		usage: "block compression (none | snappy | zstd)",
+		set:   setCompression,
+	},
+	{
+		name:  "num_compactors",
+		flag:  "num-compactors",
+		usage: "number of compaction workers, 0 disables compactions",
+		set:   intOption(func(c *config) *int { return &c.badger.numCompactors }),
+	},
+	{
+		name:  "value_log_file_size",
+		flag:  "value-log-file-size",
+		usage: "maximum size of each value log file",
+		set:   sizeOption(func(c *config) *int64 { return &c.badger.valueLogFileSize }),
+	},
+	{
+		name:    "detect_conflicts",
+		flag:    "detect-conflicts",
+		usage:   "detect conflicts between concurrent transactions",
+		boolean: true,
+		set:     boolOption(func(c *config) *bool { return &c.badger.detectConflicts }),
+	},
+}
+
+func intOption(field func(c *config) *int) func(*config, string) error {
+	return func(c *config, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("expected an integer, got %q", value)
+		}
+		*field(c) = n
+		return nil
 	}
-	path := flag.String("d", "./data", "the directory path used for the database")
-	if path == nil {
-		log.Fatal().Msg("path is invalid")
+}
+
+func floatOption(field func(c *config) *float64) func(*config, string) error {
+	return func(c *config, value string) error {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("expected a number, got %q", value)
+		}
+		*field(c) = f
+		return nil
 	}
-	loggingLevelStr := flag.String("l", "warn", "logging level (debug | info | warn | error)")
-	if loggingLevelStr == nil {
-		log.Fatal().Msg("loggingLevelStr is invalid")
+}
+
+func stringOption(field func(c *config) *string) func(*config, string) error {
+	return func(c *config, value string) error {
+		*field(c) = value
+		return nil
 	}
+}
 
-	return &config{
-		port:     *port,
-		path:     *path,
-		loglevel: *loggingLevelStr,
+func boolOption(field func(c *config) *bool) func(*config, string) error {
+	return func(c *config, value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("expected a boolean, got %q", value)
+		}
+		*field(c) = b
+		return nil
+	}
+}
+
+func sizeOption(field func(c *config) *int64) func(*config, string) error {
+	return func(c *config, value string) error {
+		n, err := parseSize(value)
+		if err != nil {
+			return err
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+// sizeUnits are the suffixes accepted by parseSize, in powers of 1024
+var sizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+// parseSize parses a byte size such as 512, 64KB, 1MB or 2GB
+func parseSize(value string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(value))
+	unit := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s, unit = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("expected a size such as 64MB, got %q", value)
+	}
+	return n * unit, nil
+}
+
+func setCompression(c *config, value string) error {
+	switch value {
+	case "none":
+		c.badger.compression = options.None
+	case "snappy":
+		c.badger.compression = options.Snappy
+	case "zstd":
+		c.badger.compression = options.ZSTD
+	default:
+		return fmt.Errorf("expected none, snappy or zstd, got %q", value)
+	}
+	return nil
+}
+
+func durationOption(field func(c *config) *time.Duration) func(*config, string) error {
+	return func(c *config, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("expected a duration such as 30s, got %q", value)
+		}
+		*field(c) = d
+		return nil
+	}
+}
+
+// setDatabases parses databases in the form of name=path[,sync][,memory]
+// separated by ;
+func setDatabases(c *config, value string) error {
+	for _, spec := range strings.Split(value, ";") {
+		if spec == "" {
+			continue
+		}
+		eq := strings.Index(spec, "=")
+		if eq < 0 {
+			return fmt.Errorf("expected name=path, got %q", spec)
+		}
+		opts := strings.Split(spec[eq+1:], ",")
+		d := databaseConfig{
+			name: spec[:eq],
+			path: opts[0],
+		}
+		for _, opt := range opts[1:] {
+			switch opt {
+			case "sync":
+				d.syncWrites = true
+			case "memory":
+				d.inMemory = true
+			default:
+				return fmt.Errorf("unknown database option %q", opt)
+			}
+		}
+		c.databases = append(c.databases, d)
+	}
+	return nil
+}
+
+// setTokens parses tokens in the form of id=sha256[,admin] separated by ;
+func setTokens(c *config, value string) error {
+	for _, spec := range strings.Split(value, ";") {
+		if spec == "" {
+			continue
+		}
+		eq := strings.Index(spec, "=")
+		if eq < 0 {
+			return fmt.Errorf("expected id=sha256, got %q", spec)
+		}
+		opts := strings.Split(spec[eq+1:], ",")
+		t := tokenConfig{
+			id:   spec[:eq],
+			hash: opts[0],
+		}
+		for _, opt := range opts[1:] {
+			switch opt {
+			case "admin":
+				t.admin = true
+			default:
+				return fmt.Errorf("unknown token option %q", opt)
+			}
+		}
+		c.tokens = append(c.tokens, t)
+	}
+	return nil
+}
+
+func decodeTokens(c *config, raw json.RawMessage) error {
+	var tokens []struct {
+		ID     string `json:"id"`
+		SHA256 string `json:"sha256"`
+		Admin  bool   `json:"admin"`
+	}
+	if err := decodeStrict(raw, &tokens); err != nil {
+		return err
+	}
+	for _, t := range tokens {
+		c.tokens = append(c.tokens, tokenConfig{
+			id:    t.ID,
+			hash:  t.SHA256,
+			admin: t.Admin,
+		})
+	}
+	return nil
+}
+
+// setLimits parses limits in the form of by[@method]=rate[,burst=N][,in_flight=N]
+// separated by ;
+func setLimits(c *config, value string) error {
+	for _, spec := range strings.Split(value, ";") {
+		if spec == "" {
+			continue
+		}
+		eq := strings.Index(spec, "=")
+		if eq < 0 {
+			return fmt.Errorf("expected by=rate, got %q", spec)
+		}
+		l := limitConfig{by: spec[:eq]}
+		if at := strings.Index(l.by, "@"); at >= 0 {
+			l.by, l.method = l.by[:at], l.by[at+1:]
+		}
+		opts := strings.Split(spec[eq+1:], ",")
+		rate, err := strconv.ParseFloat(opts[0], 64)
+		if err != nil {
+			return fmt.Errorf("expected a rate per second, got %q", opts[0])
+		}
+		l.rate = rate
+		for _, opt := range opts[1:] {
+			kv := strings.SplitN(opt, "=", 2)
+			var n int
+			if len(kv) == 2 {
+				n, err = strconv.Atoi(kv[1])
+			}
+			if len(kv) != 2 || err != nil {
+				return fmt.Errorf("expected an option such as burst=10, got %q", opt)
+			}
+			switch kv[0] {
+			case "burst":
+				l.burst = n
+			case "in_flight":
+				l.inFlight = n
+			default:
+				return fmt.Errorf("unknown limit option %q", kv[0])
+			}
+		}
+		c.limits = append(c.limits, l)
+	}
+	return nil
+}
+
+func decodeLimits(c *config, raw json.RawMessage) error {
+	var limits []struct {
+		By       string  `json:"by"`
+		Method   string  `json:"method"`
+		Rate     float64 `json:"rate"`
+		Burst    int     `json:"burst"`
+		InFlight int     `json:"in_flight"`
+	}
+	if err := decodeStrict(raw, &limits); err != nil {
+		return err
+	}
+	for _, l := range limits {
+		c.limits = append(c.limits, limitConfig{
+			by:       l.By,
+			method:   l.Method,
+			rate:     l.Rate,
+			burst:    l.Burst,
+			inFlight: l.InFlight,
+		})
+	}
+	return nil
+}
+
+// setDeadlines parses deadlines in the form of method=duration separated by ;
+func setDeadlines(c *config, value string) error {
+	for _, spec := range strings.Split(value, ";") {
+		if spec == "" {
+			continue
+		}
+		eq := strings.Index(spec, "=")
+		if eq < 0 {
+			return fmt.Errorf("expected method=duration, got %q", spec)
+		}
+		d, err := time.ParseDuration(spec[eq+1:])
+		if err != nil {
+			return fmt.Errorf("expected a duration, got %q", spec[eq+1:])
+		}
+		if c.deadlines == nil {
+			c.deadlines = make(map[string]time.Duration)
+		}
+		c.deadlines[spec[:eq]] = d
+	}
+	return nil
+}
+
+func decodeDeadlines(c *config, raw json.RawMessage) error {
+	var deadlines map[string]string
+	if err := decodeStrict(raw, &deadlines); err != nil {
+		return err
+	}
+	for method, value := range deadlines {
+		if err := setDeadlines(c, method+"="+value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setAuditRedact(c *config, value string) error {
+	for _, prefix := range strings.Split(value, ";") {
+		if prefix != "" {
+			c.audit.redact = append(c.audit.redact, prefix)
+		}
+	}
+	return nil
+}
+
+func decodeAuditRedact(c *config, raw json.RawMessage) error {
+	var prefixes []string
+	if err := decodeStrict(raw, &prefixes); err != nil {
+		return err
+	}
+	for _, prefix := range prefixes {
+		if prefix == "" {
+			return fmt.Errorf("expected a non-empty prefix")
+		}
+	}
+	c.audit.redact = append(c.audit.redact, prefixes...)
+	return nil
+}
+
+func decodeDatabases(c *config, raw json.RawMessage) error {
+	var databases []struct {
+		Name       string `json:"name"`
+		Path       string `json:"path"`
+		SyncWrites bool   `json:"sync_writes"`
+		InMemory   bool   `json:"in_memory"`
+	}
+	if err := decodeStrict(raw, &databases); err != nil {
+		return err
+	}
+	for _, d := range databases {
+		c.databases = append(c.databases, databaseConfig{
+			name:       d.Name,
+			path:       d.Path,
+			syncWrites: d.SyncWrites,
+			inMemory:   d.InMemory,
+		})
+	}
+	return nil
+}
+
+// decodeStrict decodes JSON while rejecting unknown fields
+func decodeStrict(raw json.RawMessage, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		if typeErr, ok := err.(*json.UnmarshalTypeError); ok && typeErr.Field != "" {
+			return fmt.Errorf("%s: expected %v", typeErr.Field, typeErr.Type)
+		}
+		return err
+	}
+	return nil
+}
+
+// scalarString returns a JSON string, number or boolean as the text given to
+// option.set
+func scalarString(raw json.RawMessage) (string, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s, nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return "", err
+	}
+	switch v.(type) {
+	case float64, bool:
+		return string(raw), nil
+	}
+	return "", fmt.Errorf("expected a string, number or boolean")
+}
+
+// optionValue records a flag, flags are applied after the config file and the
+// environment variables regardless of when they're parsed
+type optionValue struct {
+	option *option
+	set    *[]flagValue
+}
+
+type flagValue struct {
+	option *option
+	value  string
+}
+
+func (v optionValue) String() string {
+	return ""
+}
+
+func (v optionValue) IsBoolFlag() bool {
+	return v.option.boolean
+}
+
+func (v optionValue) Set(value string) error {
+	*v.set = append(*v.set, flagValue{v.option, value})
+	return nil
+}
+
+// parseConfig builds the configuration from the defaults, the config file,
+// the environment variables and the command line flags, in increasing order
+// of precedence
+func parseConfig(args []string, environ []string) (*config, error) {
+	fs := flag.NewFlagSet("kvrpc", flag.ContinueOnError)
+	configPath := fs.String("c", "", "path to a JSON config file, can be set with "+envPrefix+"CONFIG as well")
+	var flags []flagValue
+	for _, o := range configOptions {
+		fs.Var(optionValue{o, &flags}, o.flag, fmt.Sprintf("%s (%s)", o.usage, o.env()))
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	env := make(map[string]string)
+	for _, kv := range environ {
+		if strings.HasPrefix(kv, envPrefix) {
+			eq := strings.Index(kv, "=")
+			env[kv[:eq]] = kv[eq+1:]
+		}
+	}
+	if *configPath == "" {
+		*configPath = env[envPrefix+"CONFIG"]
+	}
+	delete(env, envPrefix+"CONFIG")
+
+	c := defaultConfig()
+	if *configPath != "" {
+		if err := c.loadFile(*configPath); err != nil {
+			return nil, err
+		}
+	}
+
+	reset := make(map[*option]bool)
+	for _, o := range configOptions {
+		value, ok := env[o.env()]
+		if !ok {
+			continue
+		}
+		delete(env, o.env())
+		if o.reset != nil {
+			o.reset(c)
+		}
+		if err := o.set(c, value); err != nil {
+			if strings.HasPrefix(value, "tcp://") || strings.HasPrefix(value, "udp://") {
+				err = fmt.Errorf("%v, it looks like the Kubernetes service link of a service named kvrpc, set enableServiceLinks: false on the pod", err)
+			}
+			return nil, fmt.Errorf("%s: %v", o.env(), err)
+		}
+	}
+	for name := range env {
+		c.unknownEnv = append(c.unknownEnv, name)
+	}
+	sort.Strings(c.unknownEnv)
+
+	for _, f := range flags {
+		if f.option.reset != nil && !reset[f.option] {
+			f.option.reset(c)
+			reset[f.option] = true
+		}
+		if err := f.option.set(c, f.value); err != nil {
+			return nil, fmt.Errorf("flag -%s: %v", f.option.flag, err)
+		}
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// loadFile applies the values of a JSON config file
+func (c *config) loadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	byName := make(map[string]*option)
+	for _, o := range configOptions {
+		byName[o.name] = o
+	}
+	for name, raw := range values {
+		o, ok := byName[name]
+		if !ok {
+			return fmt.Errorf("%s: unknown field %q", path, name)
+		}
+		if o.decode != nil {
+			err = o.decode(c, raw)
+		} else {
+			var value string
+			if value, err = scalarString(raw); err == nil {
+				err = o.set(c, value)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s: %v", path, name, err)
+		}
+	}
+	return nil
+}
+
+// validate checks the configuration, the errors are named after the fields
+// of the config file
+func (c *config) validate() error {
+	if c.port < 1 || c.port > 65535 {
+		return fmt.Errorf("port: must be between 1 and 65535, got %d", c.port)
+	}
+	if c.path == "" && !c.inMemory {
+		return fmt.Errorf("path: must not be empty")
+	}
+	if c.readOnly && c.inMemory {
+		return fmt.Errorf("read_only: an in-memory database can't be read-only")
+	}
+	switch c.loglevel {
+	case "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("log_level: must be one of debug, info, warn or error, got %q", c.loglevel)
+	}
+	names := map[string]bool{defaultDatabase: true}
+	for i, d := range c.databases {
+		if !namePattern.MatchString(d.name) {
+			return fmt.Errorf("databases[%d].name: invalid name %q", i, d.name)
+		}
+		if names[d.name] {
+			return fmt.Errorf("databases[%d].name: %q is used more than once", i, d.name)
+		}
+		names[d.name] = true
+		if d.path == "" && !d.inMemory {
+			return fmt.Errorf("databases[%d].path: must not be empty", i)
+		}
+		if c.readOnly && d.inMemory {
+			return fmt.Errorf("databases[%d].in_memory: an in-memory database can't be read-only", i)
+		}
+	}
+	if c.requestRetention <= 0 {
+		return fmt.Errorf("request_retention: must be positive")
+	}
+	if c.healthInterval <= 0 {
+		return fmt.Errorf("health_interval: must be positive")
+	}
+	if c.drainDelay < 0 {
+		return fmt.Errorf("drain_delay: must not be negative")
+	}
+	if c.shutdownTimeout <= 0 {
+		return fmt.Errorf("shutdown_timeout: must be positive")
+	}
+	if c.maxMessageSize <= 0 || c.maxMessageSize > math.MaxInt32 {
+		return fmt.Errorf("max_message_size: must be positive and less than 2GB")
+	}
+	if c.maxBatchKeys < 0 {
+		return fmt.Errorf("max_batch_keys: must not be negative")
+	}
+	if c.maxKeySize < 1 || c.maxKeySize > badgerMaxKeySize {
+		return fmt.Errorf("max_key_size: must be between 1 and %d, got %d", badgerMaxKeySize, c.maxKeySize)
+	}
+	if c.maxValueSize < 0 {
+		return fmt.Errorf("max_value_size: must not be negative")
+	}
+	if c.traceFile != "" && c.traceEndpoint != "" {
+		return fmt.Errorf("trace_file: can't be combined with trace_endpoint")
+	}
+	if c.traceEndpoint != "" {
+		if u, err := url.Parse(c.traceEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("trace_endpoint: expected an http or https URL, got %q", c.traceEndpoint)
+		}
+	}
+	if c.traceSampleRatio < 0 || c.traceSampleRatio > 1 {
+		return fmt.Errorf("trace_sample_ratio: must be between 0 and 1")
+	}
+	if c.audit.maxSize <= 0 {
+		return fmt.Errorf("audit_max_size: must be positive")
+	}
+	if c.audit.maxFiles < 1 {
+		return fmt.Errorf("audit_max_files: must be at least 1")
+	}
+	if c.slowThreshold < 0 {
+		return fmt.Errorf("slow_request_threshold: must not be negative")
+	}
+	if c.slowBufferSize < 0 {
+		return fmt.Errorf("slow_request_buffer: must not be negative")
+	}
+	if (c.tlsCert == "") != (c.tlsKey == "") {
+		return fmt.Errorf("tls_cert: must be given along with tls_key")
+	}
+	if c.tlsClientCA != "" && c.tlsCert == "" {
+		return fmt.Errorf("tls_client_ca: requires tls_cert and tls_key")
+	}
+	ids := make(map[string]bool)
+	for i, t := range c.tokens {
+		if !namePattern.MatchString(t.id) || strings.Contains(t.id, ".") {
+			return fmt.Errorf("tokens[%d].id: invalid id %q, it can't contain a dot", i, t.id)
+		}
+		if ids[t.id] {
+			return fmt.Errorf("tokens[%d].id: %q is used more than once", i, t.id)
+		}
+		ids[t.id] = true
+		if hash, err := hex.DecodeString(t.hash); err != nil || len(hash) != sha256.Size {
+			return fmt.Errorf("tokens[%d].sha256: expected a hex SHA-256 hash", i)
+		}
+	}
+	if c.jwt.jwks != "" && c.jwt.audience == "" {
+		return fmt.Errorf("jwt_audience: must be given along with jwt_jwks")
+	}
+	if c.jwt.jwks != "" && c.jwt.subjectClaim == "" {
+		return fmt.Errorf("jwt_subject_claim: must not be empty")
+	}
+	for i, l := range c.limits {
+		switch l.by {
+		case "principal", "peer", "method":
+		default:
+			return fmt.Errorf("rate_limits[%d].by: must be principal, peer or method, got %q", i, l.by)
+		}
+		if l.rate < 0 || l.burst < 0 || l.inFlight < 0 {
+			return fmt.Errorf("rate_limits[%d]: must not be negative", i)
+		}
+		if l.rate == 0 && l.inFlight == 0 {
+			return fmt.Errorf("rate_limits[%d]: needs a rate or an in_flight limit", i)
+		}
+	}
+	for method, d := range c.deadlines {
+		if method == "" {
+			return fmt.Errorf("deadlines: expected a method name or *")
+		}
+		if d <= 0 {
+			return fmt.Errorf("deadlines[%s]: must be positive", method)
+		}
+	}
+	if c.badger.memTableSize <= 0 {
+		return fmt.Errorf("mem_table_size: must be positive")
+	}
+	// Badger writes in batches of 15% of the memtable, a value has to fit in
+	// a batch unless it's stored in the value log
+	if maxThreshold := 15 * c.badger.memTableSize / 100; int64(c.badger.valueThreshold) > maxThreshold || c.badger.valueThreshold > 1<<20 {
+		return fmt.Errorf("value_threshold: must be at most 1MB and 15%% of mem_table_size")
+	}
+	if c.badger.numVersionsToKeep < 1 {
+		return fmt.Errorf("num_versions_to_keep: must be at least 1")
+	}
+	if c.badger.numCompactors == 1 || c.badger.numCompactors < 0 {
+		return fmt.Errorf("num_compactors: must be 0 or at least 2")
+	}
+	if c.badger.valueLogFileSize < 1<<20 || c.badger.valueLogFileSize >= 2<<30 {
+		return fmt.Errorf("value_log_file_size: must be at least 1MB and less than 2GB")
+	}
+	// Badger rejects the values larger than a value log file
+	if c.maxValueSize > c.badger.valueLogFileSize {
+		return fmt.Errorf("max_value_size: must be at most value_log_file_size")
+	}
+	return nil
+}
+
+func loadConfig() *config {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	c, err := parseConfig(os.Args[1:], os.Environ())
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid configuration")
+	}
+	for _, name := range c.unknownEnv {
+		log.Warn().Str("variable", name).Msg("ignoring unknown environment variable")
 	}
+	return c
 }
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3/options"
+)
+
+func TestConfigPrecedence(t *testing.T) {
+	file := writeConfig(t, `{
+		"port": 8000,
+		"path": "/from/file",
+		"log_level": "info",
+		"request_retention": "5m",
+		"databases": [{"name": "one", "path": "/one", "sync_writes": true}]
+	}`)
+	defer os.Remove(file)
+
+	c, err := parseConfig(
+		[]string{"-c", file, "-p", "7000"},
+		[]string{"KVRPC_PORT=6000", "KVRPC_PATH=/from/env", "HOME=/root"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.port != 7000 {
+		t.Errorf("expected the flag to win, got port %d", c.port)
+	}
+	if c.path != "/from/env" {
+		t.Errorf("expected the environment to win, got path %q", c.path)
+	}
+	if c.loglevel != "info" || c.requestRetention != 5*time.Minute {
+		t.Errorf("expected the file values, got %q %v", c.loglevel, c.requestRetention)
+	}
+	if c.healthInterval != defaultHealthInterval {
+		t.Errorf("expected the default health interval, got %v", c.healthInterval)
+	}
+	if len(c.databases) != 1 || c.databases[0].name != "one" || !c.databases[0].syncWrites {
+		t.Errorf("unexpected databases %v", c.databases)
+	}
+
+	// lists are replaced by a source with higher precedence
+	c, err = parseConfig(
+		[]string{"-db", "two=,memory", "-db", "three=/three"},
+		[]string{"KVRPC_CONFIG=" + file},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.databases) != 2 || c.databases[0].name != "two" || !c.databases[0].inMemory || c.databases[1].name != "three" {
+		t.Errorf("unexpected databases %v", c.databases)
+	}
+}
+
+func TestConfigBadger(t *testing.T) {
+	file := writeConfig(t, `{"mem_table_size": "128MB", "compression": "none", "detect_conflicts": false}`)
+	defer os.Remove(file)
+
+	c, err := parseConfig(
+		[]string{"-c", file, "-sync-writes", "-block-cache-size", "1GB"},
+		[]string{"KVRPC_VALUE_THRESHOLD=4KB"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := defaultBadgerOptions()
+	expected.memTableSize = 128 << 20
+	expected.compression = options.None
+	expected.detectConflicts = false
+	expected.syncWrites = true
+	expected.blockCacheSize = 1 << 30
+	expected.valueThreshold = 4 << 10
+	if c.badger != expected {
+		t.Errorf("expected %+v, got %+v", expected, c.badger)
+	}
+}
+
+func TestConfigLimits(t *testing.T) {
+	c, err := parseConfig([]string{"-rate-limit", "principal@Scan=5.5,burst=10,in_flight=2;method=0,in_flight=100"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []limitConfig{
+		{by: "principal", method: "Scan", rate: 5.5, burst: 10, inFlight: 2},
+		{by: "method", inFlight: 100},
+	}
+	if len(c.limits) != 2 || c.limits[0] != expected[0] || c.limits[1] != expected[1] {
+		t.Errorf("expected %+v, got %+v", expected, c.limits)
+	}
+}
+
+func TestConfigDeadlines(t *testing.T) {
+	c, err := parseConfig([]string{"-deadline", "*=30s;Scan=2m"}, []string{"KVRPC_DEADLINES=Get=1s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.deadlines) != 2 || c.deadlines["*"] != 30*time.Second || c.deadlines["Scan"] != 2*time.Minute {
+		t.Errorf("expected the flag to replace the environment, got %v", c.deadlines)
+	}
+}
+
+func TestConfigUnknownEnv(t *testing.T) {
+	// the service links of a Kubernetes service named kvrpc are ignored
+	c, err := parseConfig(nil, []string{
+		"KVRPC_SERVICE_HOST=10.0.0.1",
+		"KVRPC_PORT_9000_TCP=tcp://10.0.0.1:9000",
+		"KVRPC_LOG_LEVEL=info",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.unknownEnv) != 2 || c.unknownEnv[0] != "KVRPC_PORT_9000_TCP" || c.unknownEnv[1] != "KVRPC_SERVICE_HOST" {
+		t.Errorf("expected the unknown variables to be reported, got %v", c.unknownEnv)
+	}
+	if c.loglevel != "info" {
+		t.Errorf("expected the known variables to apply, got %q", c.loglevel)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	cases := []struct {
+		file     string
+		args     []string
+		env      []string
+		expected string
+	}{
+		{file: `{"prot": 1}`, expected: `unknown field "prot"`},
+		{file: `{"port": "abc"}`, expected: "port: expected an integer"},
+		{file: `{"databases": [{"name": "a", "sync": true}]}`, expected: "databases"},
+		{file: `{"databases": [{"name": "a", "path": 1}]}`, expected: "path: expected string"},
+		{env: []string{"KVRPC_PORT=tcp://10.0.0.1:9000"}, expected: "enableServiceLinks: false"},
+		{env: []string{"KVRPC_HEALTH_INTERVAL=soon"}, expected: "KVRPC_HEALTH_INTERVAL: expected a duration"},
+		{args: []string{"-p", "0"}, expected: "port: must be between"},
+		{args: []string{"-l", "verbose"}, expected: "log_level: must be one of"},
+		{args: []string{"-d", ""}, expected: "path: must not be empty"},
+		{args: []string{"-memory", "-read-only"}, expected: "read_only: an in-memory database can't be read-only"},
+		{args: []string{"-db", "a=/a;a=/b"}, expected: `databases[1].name: "a" is used more than once`},
+		{args: []string{"-db", "a="}, expected: "databases[0].path: must not be empty"},
+		{args: []string{"-tls-cert", "server.pem"}, expected: "tls_cert: must be given along with tls_key"},
+		{args: []string{"-token", "a.b=" + strings.Repeat("0", 64)}, expected: "tokens[0].id: invalid id"},
+		{env: []string{"KVRPC_TOKENS=a=abc"}, expected: "tokens[0].sha256: expected a hex SHA-256 hash"},
+		{args: []string{"-jwt-jwks", "keys.json"}, expected: "jwt_audience: must be given along with jwt_jwks"},
+		{args: []string{"-rate-limit", "user=10"}, expected: "rate_limits[0].by: must be principal, peer or method"},
+		{args: []string{"-rate-limit", "peer=10,burst"}, expected: "expected an option such as burst=10"},
+		{args: []string{"-max-key-size", "70000"}, expected: "max_key_size: must be between 1 and 65000"},
+		{args: []string{"-max-value-size", "2GB"}, expected: "max_value_size: must be at most value_log_file_size"},
+		{args: []string{"-trace-endpoint", "localhost:4318"}, expected: "trace_endpoint: expected an http or https URL"},
+		{args: []string{"-trace-sample-ratio", "2"}, expected: "trace_sample_ratio: must be between 0 and 1"},
+		{args: []string{"-audit-max-files", "0"}, expected: "audit_max_files: must be at least 1"},
+		{file: `{"audit_redact": ["secret/", ""]}`, expected: "expected a non-empty prefix"},
+		{args: []string{"-slow-request-buffer", "-1"}, expected: "slow_request_buffer: must not be negative"},
+		{args: []string{"-shutdown-timeout", "0s"}, expected: "shutdown_timeout: must be positive"},
+		{args: []string{"-deadline", "Get=soon"}, expected: "expected a duration"},
+		{args: []string{"-deadline", "Get=-1s"}, expected: "deadlines[Get]: must be positive"},
+		{args: []string{"-mem-table-size", "64XB"}, expected: "flag -mem-table-size: expected a size"},
+		{args: []string{"-compression", "lz4"}, expected: "expected none, snappy or zstd"},
+		{args: []string{"-value-threshold", "2MB"}, expected: "value_threshold: must be at most 1MB"},
+		{env: []string{"KVRPC_NUM_COMPACTORS=1"}, expected: "num_compactors: must be 0 or at least 2"},
+	}
+	for _, c := range cases {
+		args := c.args
+		if c.file != "" {
+			file := writeConfig(t, c.file)
+			defer os.Remove(file)
+			args = append([]string{"-c", file}, args...)
+		}
+		_, err := parseConfig(args, c.env)
+		if err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Errorf("expected an error containing %q, got %v", c.expected, err)
+		}
+	}
+}
+
+func writeConfig(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "kvrpc-config-*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
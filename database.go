@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	context "context"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/options"
+	"github.com/rs/zerolog/log"
+	"github.com/yndc/kvrpc/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// defaultDatabase is the name of the database opened from the path in config,
+// requests without a database name are served from it
+const defaultDatabase = "default"
+
+// databaseConfig is the configuration of a single served database
+type databaseConfig struct {
+	name       string
+	path       string
+	syncWrites bool
+	inMemory   bool
+	readOnly   bool
+}
+
+// badgerOptions are the Badger tuning options applied to every database
+type badgerOptions struct {
+	syncWrites        bool
+	memTableSize      int64
+	valueThreshold    int
+	numVersionsToKeep int
+	blockCacheSize    int64
+	indexCacheSize    int64
+	compression       options.CompressionType
+	numCompactors     int
+	valueLogFileSize  int64
+	detectConflicts   bool
+}
+
+func defaultBadgerOptions() badgerOptions {
+	opt := badger.DefaultOptions("")
+	return badgerOptions{
+		syncWrites:        opt.SyncWrites,
+		memTableSize:      opt.MemTableSize,
+		valueThreshold:    opt.ValueThreshold,
+		numVersionsToKeep: opt.NumVersionsToKeep,
+		blockCacheSize:    opt.BlockCacheSize,
+		indexCacheSize:    opt.IndexCacheSize,
+		compression:       opt.Compression,
+		numCompactors:     opt.NumCompactors,
+		valueLogFileSize:  opt.ValueLogFileSize,
+		detectConflicts:   opt.DetectConflicts,
+	}
+}
+
+func (o badgerOptions) apply(opt badger.Options) badger.Options {
+	return opt.
+		WithSyncWrites(o.syncWrites).
+		WithMemTableSize(o.memTableSize).
+		WithValueThreshold(o.valueThreshold).
+		WithNumVersionsToKeep(o.numVersionsToKeep).
+		WithBlockCacheSize(o.blockCacheSize).
+		WithIndexCacheSize(o.indexCacheSize).
+		WithCompression(o.compression).
+		WithNumCompactors(o.numCompactors).
+		WithValueLogFileSize(o.valueLogFileSize).
+		WithDetectConflicts(o.detectConflicts)
+}
+
+// database is an opened Badger database along with its bucket registry
+type database struct {
+	config databaseConfig
+	db     *badger.DB
+
+	// memtables is set when a read-only database was opened with memtables
+	// which weren't flushed to the tables
+	memtables bool
+
+	// mu is held for reading while a request uses the database, closing
+	// waits for the in-flight requests to finish
+	mu     sync.RWMutex
+	closed bool
+
+	bucketsMu sync.RWMutex
+	buckets   map[string]*bucket
+
+	quotasMu sync.RWMutex
+	quotas   map[string]*quota
+}
+
+func openDatabase(config databaseConfig, tuning badgerOptions, logger badger.Logger) (*database, error) {
+	opt := tuning.apply(badger.DefaultOptions(config.path)).
+		WithLogger(logger)
+	if config.syncWrites {
+		opt = opt.WithSyncWrites(true)
+	}
+	if config.inMemory {
+		opt = opt.WithDir("").WithValueDir("").WithInMemory(true)
+	}
+	if config.readOnly {
+		opt = opt.WithReadOnly(true)
+	}
+	db, err := badger.Open(opt)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &database{
+		config: config,
+		db:     db,
+	}
+	if config.readOnly {
+		files, _ := filepath.Glob(filepath.Join(config.path, "*.mem"))
+		d.memtables = len(files) > 0
+	}
+	if err := d.loadBuckets(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := d.loadQuotas(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *database) info() *pb.Database {
+	return &pb.Database{
+		Name:       d.config.name,
+		Path:       d.config.path,
+		SyncWrites: d.config.syncWrites,
+		InMemory:   d.config.inMemory,
+		ReadOnly:   d.config.readOnly,
+	}
+}
+
+// writable rejects the requests writing into a read-only database
+func (d *database) writable() error {
+	if d.config.readOnly {
+		return status.Errorf(codes.FailedPrecondition, "database %q is read-only", d.config.name)
+	}
+	return nil
+}
+
+// update runs fn in a read-write transaction like badger.DB.Update, the
+// phases of applying fn and committing are traced as spans of ctx and added to
+// its call stats
+func (d *database) update(ctx context.Context, fn func(txn *badger.Txn) error) error {
+	stats := callStatsFrom(ctx)
+	start := time.Now()
+	txn := d.db.NewTransaction(true)
+	defer txn.Discard()
+	applying := time.Now()
+	_, span := startSpan(ctx, "badger.apply")
+	span.setAttribute("db.name", d.config.name)
+	err := fn(txn)
+	span.finish(err)
+	committing := time.Now()
+	stats.add(applying.Sub(start), committing.Sub(applying))
+	if err != nil {
+		return err
+	}
+	_, span = startSpan(ctx, "badger.commit")
+	span.setAttribute("db.name", d.config.name)
+	err = txn.Commit()
+	span.finish(err)
+	stats.add(time.Since(committing), 0)
+	return err
+}
+
+// view runs fn in a read-only transaction like badger.DB.View, traced as a
+// span of ctx and added to its call stats
+func (d *database) view(ctx context.Context, fn func(txn *badger.Txn) error) error {
+	if d.db.IsClosed() {
+		return badger.ErrDBClosed
+	}
+	stats := callStatsFrom(ctx)
+	_, span := startSpan(ctx, "badger.view")
+	span.setAttribute("db.name", d.config.name)
+	start := time.Now()
+	txn := d.db.NewTransaction(false)
+	defer txn.Discard()
+	viewing := time.Now()
+	err := fn(txn)
+	stats.add(viewing.Sub(start), time.Since(viewing))
+	span.finish(err)
+	return err
+}
+
+// iterable reports whether the database can be iterated over the prefix. A
+// read-only database has no mutable memtable and Badger fails to build an
+// iterator when none of the tables overlap the prefix either, there's nothing
+// to iterate over in that case.
+func (d *database) iterable(prefix []byte) bool {
+	if !d.config.readOnly || d.memtables {
+		return true
+	}
+	for _, t := range d.db.Tables() {
+		// the table boundaries end with the 8 bytes version
+		left, right := t.Left[:len(t.Left)-8], t.Right[:len(t.Right)-8]
+		if comparePrefix(left, prefix) <= 0 && comparePrefix(right, prefix) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// comparePrefix compares the beginning of key with prefix
+func comparePrefix(key, prefix []byte) int {
+	if len(key) > len(prefix) {
+		key = key[:len(prefix)]
+	}
+	return bytes.Compare(key, prefix)
+}
+
+// close waits for the in-flight requests and closes the database
+func (d *database) close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+	return d.db.Close()
+}
+
+// database acquires the database with the given name, the returned function
+// must be called once the request is done with it
+func (s *Service) database(name string) (*database, func(), error) {
+	if name == "" {
+		name = defaultDatabase
+	}
+	s.dbsMu.RLock()
+	d, ok := s.dbs[name]
+	s.dbsMu.RUnlock()
+	if !ok {
+		return nil, nil, status.Errorf(codes.NotFound, "database %q is not open", name)
+	}
+	d.mu.RLock()
+	if d.closed {
+		d.mu.RUnlock()
+		// the server is shutting down, the call can be retried on another one
+		return nil, nil, status.Errorf(codes.Unavailable, "database %q is closed", name)
+	}
+	return d, d.mu.RUnlock, nil
+}
+
+// addDatabase opens and registers a database
+func (s *Service) addDatabase(config databaseConfig) error {
+	if !namePattern.MatchString(config.name) {
+		return status.Errorf(codes.InvalidArgument, "invalid database name %q", config.name)
+	}
+	if config.path == "" && !config.inMemory {
+		return status.Errorf(codes.InvalidArgument, "database %q needs a path", config.name)
+	}
+	// every database of a read-only server is opened read-only
+	config.readOnly = s.readOnly
+	if config.readOnly && config.inMemory {
+		return status.Errorf(codes.FailedPrecondition, "database %q can't be in memory on a read-only server", config.name)
+	}
+
+	exists := func() bool {
+		_, ok := s.dbs[config.name]
+		return ok
+	}
+	s.dbsMu.RLock()
+	opened := exists()
+	s.dbsMu.RUnlock()
+	if opened {
+		return status.Errorf(codes.AlreadyExists, "database %q is already open", config.name)
+	}
+
+	// opening might take a while, so it's done without blocking the lookups
+	d, err := openDatabase(config, s.badger, s.logger)
+	if err != nil {
+		return err
+	}
+	s.dbsMu.Lock()
+	if exists() {
+		s.dbsMu.Unlock()
+		d.close()
+		return status.Errorf(codes.AlreadyExists, "database %q is already open", config.name)
+	}
+	s.dbs[config.name] = d
+	s.dbsMu.Unlock()
+	log.Info().Str("database", config.name).Str("path", config.path).Msg("database opened")
+	return nil
+}
+
+// OpenDatabase opens a database at runtime
+func (s *Service) OpenDatabase(ctx context.Context, in *pb.OpenDatabaseRequest) (*pb.Database, error) {
+	if err := s.authorizeAdmin(ctx, in.Name, anyName); err != nil {
+		return nil, err
+	}
+	config := databaseConfig{
+		name:       in.Name,
+		path:       in.Path,
+		syncWrites: in.SyncWrites,
+		inMemory:   in.InMemory,
+	}
+	if err := s.addDatabase(config); err != nil {
+		return nil, err
+	}
+	d, release, err := s.database(in.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return d.info(), nil
+}
+
+// CloseDatabase closes a database at runtime, the default database can't be
+// closed
+func (s *Service) CloseDatabase(ctx context.Context, in *pb.CloseDatabaseRequest) (*pb.Empty, error) {
+	if in.Name == "" || in.Name == defaultDatabase {
+		return nil, status.Error(codes.FailedPrecondition, "the default database can't be closed")
+	}
+	if err := s.authorizeAdmin(ctx, in.Name, anyName); err != nil {
+		return nil, err
+	}
+
+	s.dbsMu.Lock()
+	d, ok := s.dbs[in.Name]
+	delete(s.dbs, in.Name)
+	s.dbsMu.Unlock()
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "database %q is not open", in.Name)
+	}
+
+	if err := d.close(); err != nil {
+		return nil, err
+	}
+	log.Info().Str("database", in.Name).Msg("database closed")
+	return &pb.Empty{}, nil
+}
+
+// ListDatabases returns the open databases the caller has rules for sorted by
+// name
+func (s *Service) ListDatabases(ctx context.Context, in *pb.Empty) (*pb.ListDatabasesResponse, error) {
+	s.dbsMu.RLock()
+	databases := make([]*pb.Database, 0, len(s.dbs))
+	for name, d := range s.dbs {
+		if s.listable(ctx, name, anyName) {
+			databases = append(databases, d.info())
+		}
+	}
+	s.dbsMu.RUnlock()
+
+	sort.Slice(databases, func(i, j int) bool {
+		return databases[i].Name < databases[j].Name
+	})
+	return &pb.ListDatabasesResponse{
+		Databases: databases,
+	}, nil
+}
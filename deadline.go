@@ -0,0 +1,36 @@
+package main
+
+import (
+	context "context"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// deadline returns the default deadline of the method, which is looked up by
+// its full name, its name such as Set and then anyName
+func (s *Service) deadline(method string) (time.Duration, bool) {
+	if d, ok := s.deadlines[method]; ok {
+		return d, true
+	}
+	if d, ok := s.deadlines[method[strings.LastIndex(method, "/")+1:]]; ok {
+		return d, true
+	}
+	d, ok := s.deadlines[anyName]
+	return d, ok
+}
+
+// deadlineUnary applies the default deadline of the method to the calls
+// which come without one
+func (s *Service) deadlineUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if _, ok := ctx.Deadline(); ok || strings.HasPrefix(info.FullMethod, healthMethodPrefix) {
+		return handler(ctx, req)
+	}
+	if d, ok := s.deadline(info.FullMethod); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	return handler(ctx, req)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	context "context"
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/yndc/kvrpc/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// keyError is an error caused by one of the keys of a request
+type keyError struct {
+	index int
+	err   error
+}
+
+func (e *keyError) Error() string {
+	return fmt.Sprintf("key %d: %v", e.index, e.err)
+}
+
+func (e *keyError) Unwrap() error {
+	return e.err
+}
+
+// retryableCode reports whether an error with the code may go away on its own
+func retryableCode(c codes.Code) bool {
+	return c == codes.Aborted || c == codes.Unavailable
+}
+
+// withDetail attaches an ErrorDetail to the status, the index is -1 when the
+// error isn't about a single key
+func withDetail(s *status.Status, index int, retryable bool) *status.Status {
+	detailed, err := s.WithDetails(&pb.ErrorDetail{
+		KeyIndex:  int32(index),
+		Retryable: retryable,
+	})
+	if err != nil {
+		return s
+	}
+	return detailed
+}
+
+// keyStatusf returns a status error about the key i of the request
+func keyStatusf(c codes.Code, i int, format string, args ...interface{}) error {
+	return withDetail(status.Newf(c, format, args...), i, retryableCode(c)).Err()
+}
+
+// statusError translates err into a status error carrying an ErrorDetail,
+// the errors of Badger get the code of their cause
+func statusError(err error) error {
+	if err == nil {
+		return nil
+	}
+	index := -1
+	var ke *keyError
+	if errors.As(err, &ke) {
+		index = ke.index
+	}
+	if s, ok := status.FromError(err); ok {
+		for _, d := range s.Details() {
+			if _, ok := d.(*pb.ErrorDetail); ok {
+				return err
+			}
+		}
+		return withDetail(s, index, retryableCode(s.Code())).Err()
+	}
+
+	var c codes.Code
+	switch {
+	case errors.Is(err, badger.ErrTxnTooBig):
+		c = codes.ResourceExhausted
+	case errors.Is(err, badger.ErrConflict):
+		c = codes.Aborted
+	case errors.Is(err, badger.ErrEmptyKey), errors.Is(err, badger.ErrInvalidKey):
+		c = codes.InvalidArgument
+	case errors.Is(err, badger.ErrDBClosed), errors.Is(err, badger.ErrBlockedWrites):
+		c = codes.Unavailable
+	case errors.Is(err, badger.ErrReadOnlyTxn):
+		c = codes.FailedPrecondition
+	case errors.Is(err, context.Canceled):
+		c = codes.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		c = codes.DeadlineExceeded
+	default:
+		c = codes.Internal
+	}
+	return withDetail(status.New(c, err.Error()), index, retryableCode(c)).Err()
+}
+
+// errorsUnary translates the errors of the unary calls
+func (s *Service) errorsUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	res, err := handler(ctx, req)
+	return res, statusError(err)
+}
+
+// errorsStream translates the errors of the streams
+func (s *Service) errorsStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return statusError(handler(srv, ss))
+}
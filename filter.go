@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/yndc/kvrpc/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// filter is a compiled pb.Filter
+type filter struct {
+	keyRegex      *regexp.Regexp
+	keyGlob       *regexp.Regexp
+	valuePrefix   []byte
+	valueContains []byte
+	jsonPath      []string
+	jsonValue     interface{}
+	minSize       uint64
+	maxSize       uint64
+}
+
+func compileFilter(in *pb.Filter) (*filter, error) {
+	f := &filter{}
+	if in == nil {
+		return f, nil
+	}
+	var err error
+	if in.KeyRegex != "" {
+		f.keyRegex, err = regexp.Compile(in.KeyRegex)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid key regex: %v", err)
+		}
+	}
+	if in.KeyGlob != "" {
+		f.keyGlob = globToRegexp(in.KeyGlob)
+	}
+	f.valuePrefix = in.ValuePrefix
+	f.valueContains = in.ValueContains
+	if in.JsonField != nil {
+		if in.JsonField.Path == "" {
+			return nil, status.Error(codes.InvalidArgument, "json field filter needs a path")
+		}
+		f.jsonPath = strings.Split(in.JsonField.Path, ".")
+		if err := json.Unmarshal([]byte(in.JsonField.Value), &f.jsonValue); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid json field value: %v", err)
+		}
+	}
+	if in.MaxSize > 0 && in.MinSize > in.MaxSize {
+		return nil, status.Error(codes.InvalidArgument, "min size is larger than max size")
+	}
+	f.minSize = in.MinSize
+	f.maxSize = in.MaxSize
+	return f, nil
+}
+
+// globToRegexp converts a glob pattern into an anchored regular expression
+func globToRegexp(glob string) *regexp.Regexp {
+	var sb strings.Builder
+	sb.WriteString(`(?s)^`)
+	for _, r := range glob {
+		switch r {
+		case '*':
+			sb.WriteString(`.*`)
+		case '?':
+			sb.WriteString(`.`)
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString(`$`)
+	return regexp.MustCompile(sb.String())
+}
+
+// needsValue reports whether the value has to be read to evaluate the filter
+func (f *filter) needsValue() bool {
+	return f.valuePrefix != nil || f.valueContains != nil || f.jsonPath != nil
+}
+
+// matchKey evaluates the conditions that only need the key and the value size
+func (f *filter) matchKey(key []byte, size uint64) bool {
+	if f.keyRegex != nil && !f.keyRegex.Match(key) {
+		return false
+	}
+	if f.keyGlob != nil && !f.keyGlob.Match(key) {
+		return false
+	}
+	if size < f.minSize {
+		return false
+	}
+	if f.maxSize > 0 && size > f.maxSize {
+		return false
+	}
+	return true
+}
+
+// matchValue evaluates the conditions on the value
+func (f *filter) matchValue(val []byte) bool {
+	if f.valuePrefix != nil && !bytes.HasPrefix(val, f.valuePrefix) {
+		return false
+	}
+	if f.valueContains != nil && !bytes.Contains(val, f.valueContains) {
+		return false
+	}
+	if f.jsonPath != nil {
+		var doc interface{}
+		if err := json.Unmarshal(val, &doc); err != nil {
+			return false
+		}
+		for _, field := range f.jsonPath {
+			obj, ok := doc.(map[string]interface{})
+			if !ok {
+				return false
+			}
+			if doc, ok = obj[field]; !ok {
+				return false
+			}
+		}
+		if !reflect.DeepEqual(doc, f.jsonValue) {
+			return false
+		}
+	}
+	return true
+}
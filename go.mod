@@ -4,6 +4,7 @@ go 1.15
 
 require (
 	github.com/dgraph-io/badger/v3 v3.2011.0
+	github.com/dgraph-io/ristretto v0.0.4-0.20201205013540-bafef7527542
 	github.com/golang/protobuf v1.4.3
 	github.com/rs/zerolog v1.20.0
 	golang.org/x/net v0.0.0-20201224014010-6772e930b67b // indirect
@@ -0,0 +1,168 @@
+package main
+
+import (
+	context "context"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// kvrpcServiceName is the service name of KVRPC in the health checks
+const kvrpcServiceName = "pb.KVRPC"
+
+// defaultHealthInterval is the interval of the health checks when it isn't
+// configured
+const defaultHealthInterval = 10 * time.Second
+
+// healthChecker keeps the standard gRPC health service in sync with the
+// default database. The overall status follows whether the database is open
+// and KVRPC is only serving while the database is writable as well, which
+// isn't probed on a read-only server. Both stop serving once the server starts
+// draining. The Watch streams are ended before the server stops, which would
+// otherwise wait for them.
+type healthChecker struct {
+	server   *health.Server
+	service  *Service
+	interval time.Duration
+
+	mu       sync.Mutex
+	draining bool
+	stop     chan struct{}
+	ending   bool
+	ended    chan struct{}
+}
+
+func newHealthChecker(service *Service, interval time.Duration) *healthChecker {
+	if interval <= 0 {
+		interval = defaultHealthInterval
+	}
+	h := &healthChecker{
+		server:   health.NewServer(),
+		service:  service,
+		interval: interval,
+		stop:     make(chan struct{}),
+		ended:    make(chan struct{}),
+	}
+	h.check()
+	return h
+}
+
+// run checks the database periodically until the server starts draining
+func (h *healthChecker) run() {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.check()
+		case <-h.stop:
+			return
+		}
+	}
+}
+
+// check probes the default database and updates the serving status
+func (h *healthChecker) check() {
+	open, writable := false, false
+	if d, release, err := h.service.database(defaultDatabase); err == nil {
+		open = true
+		writable = h.probe(d)
+		release()
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.draining {
+		return
+	}
+	h.server.SetServingStatus("", servingStatus(open))
+	h.server.SetServingStatus(kvrpcServiceName, servingStatus(open && writable))
+}
+
+// probe writes a short-lived key to check whether the database is writable, a
+// read-only database is never written into
+func (h *healthChecker) probe(d *database) bool {
+	if d.config.readOnly {
+		return true
+	}
+	err := d.db.Update(func(txn *badger.Txn) error {
+		entry := badger.NewEntry(reservedKey("health"), nil).WithTTL(h.interval)
+		return txn.SetEntry(entry)
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("health check write failed")
+	}
+	return err == nil
+}
+
+// drain marks every service as not serving and stops the checks
+func (h *healthChecker) drain() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.draining {
+		return
+	}
+	h.draining = true
+	close(h.stop)
+	h.server.Shutdown()
+}
+
+// endWatches ends the Watch streams in flight and the ones opened after it
+func (h *healthChecker) endWatches() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.ending {
+		return
+	}
+	h.ending = true
+	close(h.ended)
+}
+
+// Check returns the serving status of the service
+func (h *healthChecker) Check(ctx context.Context, in *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	return h.server.Check(ctx, in)
+}
+
+// Watch streams the serving status of the service until the client leaves or
+// the watches are ended
+func (h *healthChecker) Watch(in *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-h.ended:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	err := h.server.Watch(in, watchStream{stream, ctx})
+	select {
+	case <-h.ended:
+		return status.Error(codes.Unavailable, "the server is shutting down")
+	default:
+		return err
+	}
+}
+
+// watchStream is a Watch stream with the context of the watch
+type watchStream struct {
+	healthpb.Health_WatchServer
+	ctx context.Context
+}
+
+func (s watchStream) Context() context.Context {
+	return s.ctx
+}
+
+func servingStatus(serving bool) healthpb.HealthCheckResponse_ServingStatus {
+	if serving {
+		return healthpb.HealthCheckResponse_SERVING
+	}
+	return healthpb.HealthCheckResponse_NOT_SERVING
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	context "context"
+	"crypto/sha256"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// defaultRequestRetention is used when the retention isn't configured
+const defaultRequestRetention = time.Hour
+
+// maxConflictRetries is the number of times an idempotent update is retried
+// after conflicting with a concurrent request
+const maxConflictRetries = 3
+
+// idempotencyKey identifies a request by its id, scoped to the method, the
+// principal and the namespace. The hash of the request is recorded along with
+// the response, so reusing the id for a different request is rejected instead
+// of returning the response of the first one.
+type idempotencyKey struct {
+	id   string
+	key  []byte
+	hash []byte
+}
+
+// newIdempotencyKey returns the key of the request, it's nil without a request
+// id
+func newIdempotencyKey(ctx context.Context, method, namespace, requestID string, in proto.Message) (*idempotencyKey, error) {
+	if requestID == "" {
+		return nil, nil
+	}
+	var id string
+	if p := principalFrom(ctx); p != nil {
+		id = p.id
+	}
+	content, err := proto.MarshalOptions{Deterministic: true}.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(content)
+	return &idempotencyKey{
+		id:   requestID,
+		key:  reservedKey("request", method, id, namespace, requestID),
+		hash: hash[:],
+	}, nil
+}
+
+// decode decodes the recorded response into res
+func (k *idempotencyKey) decode(val []byte, res proto.Message) error {
+	if len(val) < sha256.Size || !bytes.Equal(val[:sha256.Size], k.hash) {
+		return status.Errorf(codes.FailedPrecondition, "request id %q was used for a different request", k.id)
+	}
+	return proto.Unmarshal(val[sha256.Size:], res)
+}
+
+// recorded looks up the response recorded for the request and decodes it into
+// res
+func (s *Service) recorded(d *database, k *idempotencyKey, res proto.Message) (bool, error) {
+	if k == nil {
+		return false, nil
+	}
+	found := false
+	err := d.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(k.key)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		found = true
+		return item.Value(func(val []byte) error {
+			return k.decode(val, res)
+		})
+	})
+	return found, err
+}
+
+// record stores the response of the request inside txn, it's kept for the
+// configured retention
+func (s *Service) record(txn *badger.Txn, k *idempotencyKey, res proto.Message) error {
+	if k == nil {
+		return nil
+	}
+	val, err := proto.Marshal(res)
+	if err != nil {
+		return err
+	}
+	val = append(append([]byte{}, k.hash...), val...)
+	entry := badger.NewEntry(k.key, val).WithTTL(s.requestRetention)
+	return txn.SetEntry(entry)
+}
+
+// idempotent runs update in a transaction which also records res under the
+// request key. When the request was already recorded, the recorded response
+// is decoded into res instead of running update again. It reports whether the
+// committed transaction was the one of update.
+func (s *Service) idempotent(ctx context.Context, d *database, k *idempotencyKey, res proto.Message, update func(txn *badger.Txn) error) (bool, error) {
+	if k == nil {
+		err := d.update(ctx, update)
+		return err == nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		applied := false
+		err := d.update(ctx, func(txn *badger.Txn) error {
+			item, err := txn.Get(k.key)
+			if err == nil {
+				return item.Value(func(val []byte) error {
+					return k.decode(val, res)
+				})
+			}
+			if err != badger.ErrKeyNotFound {
+				return err
+			}
+			if err := update(txn); err != nil {
+				return err
+			}
+			applied = true
+			return s.record(txn, k, res)
+		})
+		// a duplicate running concurrently conflicts on the request key,
+		// retrying returns the response recorded by the other one
+		if err == badger.ErrConflict && attempt < maxConflictRetries {
+			continue
+		}
+		return applied && err == nil, err
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	context "context"
+	"sort"
+	"time"
+
+	"github.com/yndc/kvrpc/pb"
+)
+
+// version is the build version, set with -ldflags "-X main.version=..."
+var version = "dev"
+
+// Ping reports the server info and the status of the open databases the
+// caller has rules for
+func (s *Service) Ping(ctx context.Context, in *pb.Empty) (*pb.PingResponse, error) {
+	persistent := false
+	s.dbsMu.RLock()
+	databases := make([]*pb.DatabaseStatus, 0, len(s.dbs))
+	for name, d := range s.dbs {
+		if name == defaultDatabase {
+			persistent = !d.config.inMemory
+		}
+		if !s.listable(ctx, name, anyName) {
+			continue
+		}
+		lsm, vlog := d.db.Size()
+		databases = append(databases, &pb.DatabaseStatus{
+			Database: d.info(),
+			LsmSize:  lsm,
+			VlogSize: vlog,
+		})
+	}
+	s.dbsMu.RUnlock()
+
+	sort.Slice(databases, func(i, j int) bool {
+		return databases[i].Database.Name < databases[j].Database.Name
+	})
+	return &pb.PingResponse{
+		Response:   "pong",
+		Version:    version,
+		ReadOnly:   s.readOnly,
+		Uptime:     int64(time.Since(s.started).Seconds()),
+		Databases:  databases,
+		Persistent: persistent,
+	}, nil
+}
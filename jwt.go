@@ -0,0 +1,295 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// jwtLeeway is the clock skew tolerated when checking the expiry
+const jwtLeeway = 30 * time.Second
+
+// jwksCheckInterval is how often the JWKS file is checked for changes
+const jwksCheckInterval = time.Second
+
+// jwtConfig is the configuration of the JWT authentication, the claims are
+// given as paths separated by dots
+type jwtConfig struct {
+	jwks         string
+	audience     string
+	issuer       string
+	subjectClaim string
+	groupsClaim  string
+	tenantClaim  string
+	adminGroup   string
+}
+
+// jwtVerifier verifies RS256 and ES256 signed JWTs with the keys of a JWKS
+// file and maps their claims into a principal. The file is reloaded once it
+// changes.
+type jwtVerifier struct {
+	config jwtConfig
+
+	mu      sync.Mutex
+	checked time.Time
+	modTime int64
+	keys    map[string]crypto.PublicKey
+}
+
+func newJWTVerifier(config jwtConfig) (*jwtVerifier, error) {
+	v := &jwtVerifier{config: config}
+	if err := v.load(); err != nil {
+		return nil, err
+	}
+	v.checked = time.Now()
+	return v, nil
+}
+
+// load reads the JWKS file unless it wasn't modified since the last load
+func (v *jwtVerifier) load() error {
+	info, err := os.Stat(v.config.jwks)
+	if err != nil {
+		return err
+	}
+	if v.keys != nil && info.ModTime().UnixNano() == v.modTime {
+		return nil
+	}
+	data, err := ioutil.ReadFile(v.config.jwks)
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return fmt.Errorf("invalid JWKS %s: %v", v.config.jwks, err)
+	}
+	if v.keys != nil {
+		log.Info().Str("jwks", v.config.jwks).Msg("JWKS reloaded")
+	}
+	v.keys = keys
+	v.modTime = info.ModTime().UnixNano()
+	return nil
+}
+
+// key returns the key with the given id, the id can be left out when there's
+// only a single key
+func (v *jwtVerifier) key(kid string) (crypto.PublicKey, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if time.Since(v.checked) >= jwksCheckInterval {
+		v.checked = time.Now()
+		if err := v.load(); err != nil {
+			log.Error().Err(err).Msg("failed to reload the JWKS, keeping the previous keys")
+		}
+	}
+	if kid == "" && len(v.keys) == 1 {
+		for _, key := range v.keys {
+			return key, true
+		}
+	}
+	key, ok := v.keys[kid]
+	return key, ok
+}
+
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for i, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+			if err1 != nil || err2 != nil || len(e) == 0 || len(e) > 4 {
+				return nil, fmt.Errorf("key %d has an invalid RSA modulus or exponent", i)
+			}
+			keys[k.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		case "EC":
+			if k.Crv != "P-256" {
+				return nil, fmt.Errorf("key %d uses the unsupported curve %q", i, k.Crv)
+			}
+			x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+			key := &ecdsa.PublicKey{
+				Curve: elliptic.P256(),
+				X:     new(big.Int).SetBytes(x),
+				Y:     new(big.Int).SetBytes(y),
+			}
+			if err1 != nil || err2 != nil || !key.Curve.IsOnCurve(key.X, key.Y) {
+				return nil, fmt.Errorf("key %d has an invalid EC point", i)
+			}
+			keys[k.Kid] = key
+		default:
+			return nil, fmt.Errorf("key %d has the unsupported type %q", i, k.Kty)
+		}
+	}
+	return keys, nil
+}
+
+// isJWT reports whether the token looks like a JWT rather than a static token
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// verify checks the signature and the claims of the token and returns its
+// principal
+func (v *jwtVerifier) verify(token string) (*principal, error) {
+	invalid := func(reason string) error {
+		return status.Errorf(codes.Unauthenticated, "invalid token: %s", reason)
+	}
+	parts := strings.Split(token, ".")
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, invalid("malformed header")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, invalid("malformed signature")
+	}
+	key, ok := v.key(header.Kid)
+	if !ok {
+		return nil, invalid("unknown key")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) != nil {
+			return nil, invalid("bad signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 {
+			return nil, invalid("bad signature")
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(key, digest[:], r, s) {
+			return nil, invalid("bad signature")
+		}
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, invalid("malformed claims")
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, invalid("missing expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return nil, invalid("expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, invalid("not valid yet")
+	}
+	if !hasAudience(claims["aud"], v.config.audience) {
+		return nil, invalid("wrong audience")
+	}
+	if v.config.issuer != "" && claims["iss"] != v.config.issuer {
+		return nil, invalid("wrong issuer")
+	}
+
+	subject, _ := claim(claims, v.config.subjectClaim).(string)
+	if subject == "" {
+		return nil, invalid("missing subject")
+	}
+	// the subjects are prefixed so that they can't take the rules of a token
+	// or a group
+	p := &principal{id: jwtPrincipalPrefix + subject}
+	switch groups := claim(claims, v.config.groupsClaim).(type) {
+	case []interface{}:
+		for _, g := range groups {
+			if g, ok := g.(string); ok {
+				p.groups = append(p.groups, g)
+			}
+		}
+	case string:
+		p.groups = strings.Fields(groups)
+	}
+	for _, g := range p.groups {
+		if v.config.adminGroup != "" && g == v.config.adminGroup {
+			p.admin = true
+		}
+	}
+	if v.config.tenantClaim != "" {
+		p.tenant, _ = claim(claims, v.config.tenantClaim).(string)
+		if p.tenant == "" {
+			return nil, invalid("missing tenant")
+		}
+	}
+	return p, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// claim looks up a claim by its path separated by dots
+func claim(claims map[string]interface{}, path string) interface{} {
+	if path == "" {
+		return nil
+	}
+	var value interface{} = claims
+	for _, name := range strings.Split(path, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[name]
+	}
+	return value
+}
+
+// hasAudience checks the aud claim, which is either a string or a list
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
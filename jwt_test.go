@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yndc/kvrpc/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestJWT(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kid": "rsa", "kty": "RSA", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kid": "ec", "kty": "EC", "crv": "P-256", "x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())},
+	}})
+	file, err := ioutil.TempFile("", "kvrpc-jwks-*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.Write(jwks)
+	file.Close()
+
+	config := defaultConfig()
+	config.inMemory = true
+	config.loglevel = "error"
+	config.jwt.jwks = file.Name()
+	config.jwt.audience = "kvrpc"
+	config.jwt.groupsClaim = "realm.groups"
+	config.jwt.tenantClaim = "tenant"
+	config.jwt.adminGroup = "ops"
+	service := NewService(config)
+	defer service.Close()
+
+	sign := func(alg string, claims map[string]interface{}) string {
+		kid := map[string]string{"RS256": "rsa", "ES256": "ec"}[alg]
+		header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid})
+		payload, _ := json.Marshal(claims)
+		input := b64(header) + "." + b64(payload)
+		digest := sha256.Sum256([]byte(input))
+		var sig []byte
+		if alg == "RS256" {
+			sig, _ = rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+		} else {
+			r, s, _ := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+			sig = make([]byte, 64)
+			r.FillBytes(sig[:32])
+			s.FillBytes(sig[32:])
+		}
+		return input + "." + b64(sig)
+	}
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"sub":    "billing",
+			"aud":    []string{"other", "kvrpc"},
+			"exp":    time.Now().Add(time.Hour).Unix(),
+			"tenant": "acme",
+			"realm":  map[string]interface{}{"groups": []string{"services"}},
+		}
+	}
+
+	for _, alg := range []string{"RS256", "ES256"} {
+		p, err := service.jwt.verify(sign(alg, valid()))
+		if err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		if p.id != "jwt:billing" || p.admin || p.tenant != "acme" || len(p.groups) != 1 || p.groups[0] != "services" {
+			t.Errorf("%s: unexpected principal %+v", alg, p)
+		}
+	}
+
+	cases := map[string]func(claims map[string]interface{}){
+		"expired":        func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() },
+		"wrong audience": func(c map[string]interface{}) { c["aud"] = "other" },
+		"missing tenant": func(c map[string]interface{}) { delete(c, "tenant") },
+	}
+	for reason, modify := range cases {
+		claims := valid()
+		modify(claims)
+		if _, err := service.jwt.verify(sign("RS256", claims)); err == nil || !strings.Contains(err.Error(), reason) {
+			t.Errorf("expected an error containing %q, got %v", reason, err)
+		}
+	}
+	token := sign("RS256", valid())
+	tampered := token[:strings.LastIndex(token, ".")] + "." + b64(make([]byte, 256))
+	if _, err := service.jwt.verify(tampered); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected a tampered token to be rejected, got %v", err)
+	}
+
+	claims := valid()
+	claims["realm"] = map[string]interface{}{"groups": []string{"ops"}}
+	if p, err := service.jwt.verify(sign("ES256", claims)); err != nil || !p.admin {
+		t.Errorf("expected the admin group to map into an admin, got %+v %v", p, err)
+	}
+
+	// requests are bound into the namespace of the tenant
+	call := func(token string, req *pb.GetRequest) (*pb.GetRequest, error) {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token))
+		info := &grpc.UnaryServerInfo{FullMethod: "/pb.KVRPC/Get"}
+		var got *pb.GetRequest
+		_, err := service.authenticateUnary(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			got = req.(*pb.GetRequest)
+			return nil, nil
+		})
+		return got, err
+	}
+	req, err := call(token, &pb.GetRequest{})
+	if err != nil || req.Namespace != "acme" {
+		t.Errorf("expected the request to be bound into the tenant, got %v %v", req, err)
+	}
+	if _, err := call(token, &pb.GetRequest{Namespace: "other"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied outside of the tenant, got %v", err)
+	}
+
+	// an admin rule of the group doesn't reach the buckets of other tenants
+	admin := withPrincipal(context.Background(), &principal{id: "root", admin: true})
+	if _, err := service.SetAccessRules(admin, &pb.PrincipalRules{
+		Principal: "group:services",
+		Rules:     []*pb.AccessRule{{Namespace: anyName, Operations: []pb.Operation{pb.Operation_ADMIN}}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"acme", "other"} {
+		if _, err := service.CreateBucket(admin, &pb.CreateBucketRequest{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bucketCall := func(method string, req interface{}, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token))
+		return service.authenticateUnary(ctx, req, &grpc.UnaryServerInfo{FullMethod: "/pb.KVRPC/" + method}, handler)
+	}
+	_, err = bucketCall("DropBucket", &pb.DropBucketRequest{Name: "other"}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return service.DropBucket(ctx, req.(*pb.DropBucketRequest))
+	})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied dropping the bucket of another tenant, got %v", err)
+	}
+	res, err := bucketCall("ListBuckets", &pb.ListBucketsRequest{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return service.ListBuckets(ctx, req.(*pb.ListBucketsRequest))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buckets := res.(*pb.ListBucketsResponse).Buckets; len(buckets) != 1 || buckets[0].Name != "acme" {
+		t.Errorf("expected only the bucket of the tenant to be listed, got %v", buckets)
+	}
+
+	// a subject named like a token or a group doesn't take its rules
+	for _, name := range []string{"token", "group:ops-readers"} {
+		if _, err := service.SetAccessRules(admin, &pb.PrincipalRules{
+			Principal: name,
+			Rules:     []*pb.AccessRule{{Namespace: "acme", Operations: []pb.Operation{pb.Operation_READ}}},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		claims := valid()
+		claims["sub"] = name
+		claims["realm"] = map[string]interface{}{"groups": []string{}}
+		p, err := service.jwt.verify(sign("RS256", claims))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := withPrincipal(context.Background(), p)
+		if err := service.authorizeKeys(ctx, pb.Operation_READ, "", "acme", [][]byte{[]byte("key")}); status.Code(err) != codes.PermissionDenied {
+			t.Errorf("expected the subject %q not to take the rules of %q, got %v", name, name, err)
+		}
+	}
+}
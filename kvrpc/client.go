@@ -2,16 +2,26 @@ package kvrpc
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"fmt"
+	"io/ioutil"
+	"time"
 
 	"github.com/yndc/kvrpc/pb"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 // Client is the wrapped GRPC client
 type Client struct {
-	conn   *grpc.ClientConn
-	client pb.KVRPCClient
+	conn      *grpc.ClientConn
+	client    pb.KVRPCClient
+	database  string
+	namespace string
 }
 
 // KeyValue is a pair of key and value
@@ -20,16 +30,114 @@ type KeyValue = pb.KeyValue
 // ValueResult is a pair of a value and it's existence
 type ValueResult = pb.ValueResult
 
+// Bucket is a namespace with an isolated keyspace
+type Bucket = pb.Bucket
+
+// Database is the description of an open database
+type Database = pb.Database
+
+// DatabaseOptions is the options to open a database with at runtime
+type DatabaseOptions struct {
+	// Path is ignored for in-memory databases
+	Path       string
+	SyncWrites bool
+	InMemory   bool
+}
+
+// Database returns a client bound to the given database which shares the
+// connection with c, the empty name is the default database
+func (c *Client) Database(name string) *Client {
+	return &Client{
+		conn:      c.conn,
+		client:    c.client,
+		database:  name,
+		namespace: c.namespace,
+	}
+}
+
+// Namespace returns a client bound to the given namespace which shares the
+// connection with c, the empty name is the default namespace
+func (c *Client) Namespace(name string) *Client {
+	return &Client{
+		conn:      c.conn,
+		client:    c.client,
+		database:  c.database,
+		namespace: name,
+	}
+}
+
+type requestIDKey struct{}
+
+// WithRequestID attaches an idempotency key to the mutating calls made with
+// the returned context. Retrying a call with the same id returns the response
+// of the first one instead of applying it again, a different call with the
+// same id fails with codes.FailedPrecondition, so a new id is needed for every
+// call. The ids are scoped to the method, the principal and the namespace.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// NewRequestID generates a random request id
+func NewRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// ServerInfo is the server and database status reported by the server
+type ServerInfo = pb.PingResponse
+
 // Ping checks the connection
 func (c *Client) Ping(ctx context.Context, opts ...grpc.CallOption) error {
 	_, err := c.client.Ping(ctx, &pb.Empty{}, opts...)
 	return err
 }
 
+// WaitReady blocks until the server reports that it's ready to serve requests
+// through the standard gRPC health service, or until ctx is done
+func (c *Client) WaitReady(ctx context.Context, opts ...grpc.CallOption) error {
+	health := healthpb.NewHealthClient(c.conn)
+	opts = append([]grpc.CallOption{grpc.WaitForReady(true)}, opts...)
+	interval := 100 * time.Millisecond
+	for {
+		res, err := health.Check(ctx, &healthpb.HealthCheckRequest{Service: "pb.KVRPC"}, opts...)
+		if err == nil && res.Status == healthpb.HealthCheckResponse_SERVING {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if err != nil {
+				return err
+			}
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+		if interval < 2*time.Second {
+			interval *= 2
+		}
+	}
+}
+
+// Info returns the server info
+func (c *Client) Info(ctx context.Context, opts ...grpc.CallOption) (*ServerInfo, error) {
+	return c.client.Ping(ctx, &pb.Empty{}, opts...)
+}
+
 // Set a value into the KV store
 func (c *Client) Set(ctx context.Context, values []*KeyValue, opts ...grpc.CallOption) ([]bool, error) {
 	res, err := c.client.Set(ctx, &pb.SetRequest{
-		Values: values,
+		Values:    values,
+		Namespace: c.namespace,
+		Database:  c.database,
+		RequestId: requestID(ctx),
 	}, opts...)
 	if err != nil {
 		return nil, err
@@ -40,7 +148,9 @@ func (c *Client) Set(ctx context.Context, values []*KeyValue, opts ...grpc.CallO
 // Get values from the KV store
 func (c *Client) Get(ctx context.Context, keys [][]byte, opts ...grpc.CallOption) ([]*ValueResult, error) {
 	res, err := c.client.Get(ctx, &pb.GetRequest{
-		Keys: keys,
+		Keys:      keys,
+		Namespace: c.namespace,
+		Database:  c.database,
 	}, opts...)
 	if err != nil {
 		return nil, err
@@ -51,12 +161,257 @@ func (c *Client) Get(ctx context.Context, keys [][]byte, opts ...grpc.CallOption
 // Del deletes values from the KV store
 func (c *Client) Del(ctx context.Context, keys [][]byte, opts ...grpc.CallOption) error {
 	_, err := c.client.Del(ctx, &pb.DelRequest{
-		Keys: keys,
+		Keys:      keys,
+		Namespace: c.namespace,
+		Database:  c.database,
+		RequestId: requestID(ctx),
+	}, opts...)
+	return err
+}
+
+// Filter selects the entries of a scan, all of the set conditions must match
+type Filter = pb.Filter
+
+// JSONFieldFilter matches JSON values with a field equal to the given value
+type JSONFieldFilter = pb.JSONFieldFilter
+
+// ScanOptions selects the entries returned by Scan and List
+type ScanOptions struct {
+	Prefix []byte
+	// Start is the key to start from, use the next key of the previous call
+	// to get the following page
+	Start []byte
+	// Limit is the maximum number of results, the server default is used
+	// when zero
+	Limit  uint32
+	Filter *Filter
+}
+
+func (c *Client) scanRequest(scan ScanOptions) *pb.ScanRequest {
+	return &pb.ScanRequest{
+		Prefix:    scan.Prefix,
+		Start:     scan.Start,
+		Limit:     scan.Limit,
+		Filter:    scan.Filter,
+		Namespace: c.namespace,
+		Database:  c.database,
+	}
+}
+
+// Scan returns the matching key-value pairs along with the start key of the
+// next page, which is empty when the scan is complete
+func (c *Client) Scan(ctx context.Context, scan ScanOptions, opts ...grpc.CallOption) ([]*KeyValue, []byte, error) {
+	res, err := c.client.Scan(ctx, c.scanRequest(scan), opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return res.Values, res.Next, nil
+}
+
+// List returns the matching keys along with the start key of the next page,
+// which is empty when the scan is complete
+func (c *Client) List(ctx context.Context, scan ScanOptions, opts ...grpc.CallOption) ([][]byte, []byte, error) {
+	res, err := c.client.List(ctx, c.scanRequest(scan), opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return res.Keys, res.Next, nil
+}
+
+// Reducer is a built-in aggregation
+type Reducer = pb.Reducer
+
+// The available reducers
+const (
+	Count          = pb.Reducer_COUNT
+	SumInt64       = pb.Reducer_SUM_INT64
+	MinMaxInt64    = pb.Reducer_MIN_MAX_INT64
+	SizeHistogram  = pb.Reducer_SIZE_HISTOGRAM
+	DistinctPrefix = pb.Reducer_DISTINCT_PREFIX
+)
+
+// AggregateResult is the summary returned by Aggregate
+type AggregateResult = pb.AggregateResponse
+
+// AggregateOptions selects the entries and the reducers of Aggregate
+type AggregateOptions struct {
+	Prefix   []byte
+	Filter   *Filter
+	Reducers []Reducer
+	// Delimiter ends the prefixes counted by DistinctPrefix, defaults to "/"
+	Delimiter []byte
+}
+
+// Aggregate runs the reducers on the server and returns the summary
+func (c *Client) Aggregate(ctx context.Context, agg AggregateOptions, opts ...grpc.CallOption) (*AggregateResult, error) {
+	return c.client.Aggregate(ctx, &pb.AggregateRequest{
+		Prefix:    agg.Prefix,
+		Filter:    agg.Filter,
+		Reducers:  agg.Reducers,
+		Delimiter: agg.Delimiter,
+		Namespace: c.namespace,
+		Database:  c.database,
+	}, opts...)
+}
+
+// CreateBucket creates a new bucket
+func (c *Client) CreateBucket(ctx context.Context, name string, opts ...grpc.CallOption) (*Bucket, error) {
+	return c.client.CreateBucket(ctx, &pb.CreateBucketRequest{
+		Name:      name,
+		Database:  c.database,
+		RequestId: requestID(ctx),
+	}, opts...)
+}
+
+// ListBuckets returns all the existing buckets
+func (c *Client) ListBuckets(ctx context.Context, opts ...grpc.CallOption) ([]*Bucket, error) {
+	res, err := c.client.ListBuckets(ctx, &pb.ListBucketsRequest{
+		Database: c.database,
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return res.Buckets, nil
+}
+
+// DropBucket deletes a bucket and all of its data
+func (c *Client) DropBucket(ctx context.Context, name string, opts ...grpc.CallOption) error {
+	_, err := c.client.DropBucket(ctx, &pb.DropBucketRequest{
+		Name:      name,
+		Database:  c.database,
+		RequestId: requestID(ctx),
+	}, opts...)
+	return err
+}
+
+// OpenDatabase opens a database on the server
+func (c *Client) OpenDatabase(ctx context.Context, name string, dbOpt DatabaseOptions, opts ...grpc.CallOption) (*Database, error) {
+	return c.client.OpenDatabase(ctx, &pb.OpenDatabaseRequest{
+		Name:       name,
+		Path:       dbOpt.Path,
+		SyncWrites: dbOpt.SyncWrites,
+		InMemory:   dbOpt.InMemory,
+	}, opts...)
+}
+
+// CloseDatabase closes a database on the server
+func (c *Client) CloseDatabase(ctx context.Context, name string, opts ...grpc.CallOption) error {
+	_, err := c.client.CloseDatabase(ctx, &pb.CloseDatabaseRequest{
+		Name: name,
+	}, opts...)
+	return err
+}
+
+// ListDatabases returns all the open databases
+func (c *Client) ListDatabases(ctx context.Context, opts ...grpc.CallOption) ([]*Database, error) {
+	res, err := c.client.ListDatabases(ctx, &pb.Empty{}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return res.Databases, nil
+}
+
+// RevokeToken rejects the token with the given id from now on, it requires an
+// admin token
+func (c *Client) RevokeToken(ctx context.Context, id string, opts ...grpc.CallOption) error {
+	_, err := c.client.RevokeToken(ctx, &pb.RevokeTokenRequest{
+		Id: id,
+	}, opts...)
+	return err
+}
+
+// AccessRule grants operations on the keys with a prefix
+type AccessRule = pb.AccessRule
+
+// PrincipalRules is the whole set of access rules of a principal
+type PrincipalRules = pb.PrincipalRules
+
+// Operation is an operation granted by an access rule
+type Operation = pb.Operation
+
+// The operations granted by access rules
+const (
+	Read   = pb.Operation_READ
+	Write  = pb.Operation_WRITE
+	Delete = pb.Operation_DELETE
+	Admin  = pb.Operation_ADMIN
+)
+
+// SetAccessRules replaces the access rules of a principal, which is a token
+// id, jwt:<subject> or group:<name>, no rules removes them. It requires an
+// admin token.
+func (c *Client) SetAccessRules(ctx context.Context, principal string, rules []*AccessRule, opts ...grpc.CallOption) error {
+	_, err := c.client.SetAccessRules(ctx, &pb.PrincipalRules{
+		Principal: principal,
+		Rules:     rules,
+	}, opts...)
+	return err
+}
+
+// ListAccessRules returns the access rules of a principal, or of every
+// principal when it's empty. It requires an admin token.
+func (c *Client) ListAccessRules(ctx context.Context, principal string, opts ...grpc.CallOption) ([]*PrincipalRules, error) {
+	res, err := c.client.ListAccessRules(ctx, &pb.ListAccessRulesRequest{
+		Principal: principal,
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return res.Principals, nil
+}
+
+// Usage is the usage of a namespace along with its quota
+type Usage = pb.Usage
+
+// QuotaOptions is the limits of a namespace, the zero values are unlimited
+type QuotaOptions struct {
+	// MaxBytes limits the total size of the keys and the values
+	MaxBytes     int64
+	MaxKeys      int64
+	MaxValueSize int64
+}
+
+// SetQuota sets the quota of the namespace of the client, a quota without
+// limits is removed. It requires an admin token.
+func (c *Client) SetQuota(ctx context.Context, quota QuotaOptions, opts ...grpc.CallOption) error {
+	_, err := c.client.SetQuota(ctx, &pb.Quota{
+		Database:     c.database,
+		Namespace:    c.namespace,
+		MaxBytes:     quota.MaxBytes,
+		MaxKeys:      quota.MaxKeys,
+		MaxValueSize: quota.MaxValueSize,
 	}, opts...)
 	return err
 }
 
-// Close the connection
+// Usage returns the usage of the namespaces with a quota in the database of
+// the client. It requires an admin token.
+func (c *Client) Usage(ctx context.Context, opts ...grpc.CallOption) ([]*Usage, error) {
+	res, err := c.client.GetUsage(ctx, &pb.GetUsageRequest{
+		Database: c.database,
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return res.Usage, nil
+}
+
+// SlowRequest is a call which took longer than the slow request threshold of
+// the server
+type SlowRequest = pb.SlowRequest
+
+// SlowRequests returns the most recent slow calls of the server, newest first.
+// It requires an admin token.
+func (c *Client) SlowRequests(ctx context.Context, opts ...grpc.CallOption) ([]*SlowRequest, error) {
+	res, err := c.client.ListSlowRequests(ctx, &pb.Empty{}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return res.Requests, nil
+}
+
+// Close the connection, which is shared with the clients created by Database
+// and Namespace
 func (c *Client) Close() error {
 	return c.conn.Close()
 }
@@ -65,17 +420,95 @@ func (c *Client) Close() error {
 type ClientOptions struct {
 	Address     string
 	DialOptions []grpc.DialOption
+	// Database binds the client into a database, leave empty for the default
+	Database string
+	// Namespace binds the client into a namespace, leave empty for the default
+	Namespace string
+
+	// TLS connects with TLS, it's implied by the other TLS options. The server
+	// is verified with the system roots unless CAFile is given.
+	TLS bool
+	// CAFile is the PEM bundle of the CAs to verify the server with
+	CAFile string
+	// CertFile and KeyFile is the PEM client certificate for mutual TLS
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the name the server certificate is verified for
+	ServerName string
+
+	// Token is attached to every call as a bearer token, it's given as
+	// <id>.<secret>. It's sent over plaintext connections too, so TLS should
+	// be used outside of trusted networks.
+	Token string
+}
+
+// tokenCredentials attaches a bearer token to the calls
+type tokenCredentials string
+
+func (t tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+func (t tokenCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+// tlsConfig builds the TLS config from the options, it's nil without TLS
+func (opt ClientOptions) tlsConfig() (*tls.Config, error) {
+	if !opt.TLS && opt.CAFile == "" && opt.CertFile == "" && opt.KeyFile == "" && opt.ServerName == "" {
+		return nil, nil
+	}
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: opt.ServerName,
+	}
+	if opt.CAFile != "" {
+		pem, err := ioutil.ReadFile(opt.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", opt.CAFile)
+		}
+	}
+	if opt.CertFile != "" || opt.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opt.CertFile, opt.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
 }
 
 // NewClient creates a new KVRPC client
 func NewClient(opt ClientOptions) (*Client, error) {
-	conn, err := grpc.Dial(opt.Address, opt.DialOptions...)
+	dialOptions := opt.DialOptions
+	tlsConfig, err := opt.tlsConfig()
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLS options: %v", err)
+	}
+	if tlsConfig != nil {
+		creds := grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))
+		dialOptions = append([]grpc.DialOption{creds}, dialOptions...)
+	}
+	if opt.Token != "" {
+		creds := grpc.WithPerRPCCredentials(tokenCredentials(opt.Token))
+		dialOptions = append([]grpc.DialOption{creds}, dialOptions...)
+	}
+	// the trace context is added before the interceptors of the dial options
+	dialOptions = append([]grpc.DialOption{grpc.WithChainUnaryInterceptor(traceUnary)}, dialOptions...)
+
+	conn, err := grpc.Dial(opt.Address, dialOptions...)
 	if err != nil {
 		return nil, fmt.Errorf("can't connect: %v", err)
 	}
 
 	return &Client{
-		conn:   conn,
-		client: pb.NewKVRPCClient(conn),
+		conn:      conn,
+		client:    pb.NewKVRPCClient(conn),
+		database:  opt.Database,
+		namespace: opt.Namespace,
 	}, nil
 }
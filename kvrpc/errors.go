@@ -0,0 +1,96 @@
+package kvrpc
+
+import (
+	"github.com/yndc/kvrpc/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrorDetail is the detail attached by the server to its errors
+type ErrorDetail = pb.ErrorDetail
+
+// Error is an error returned by the server
+type Error struct {
+	Code    codes.Code
+	Message string
+	// KeyIndex is the index of the key of the request which caused the
+	// error, -1 when the error isn't about a single key
+	KeyIndex  int
+	Retryable bool
+}
+
+func (e *Error) Error() string {
+	return e.Code.String() + ": " + e.Message
+}
+
+// AsError returns the details of an error returned by the client, it's false
+// for errors which don't come from a call
+func AsError(err error) (*Error, bool) {
+	s, ok := status.FromError(err)
+	if !ok || err == nil {
+		return nil, false
+	}
+	e := &Error{
+		Code:      s.Code(),
+		Message:   s.Message(),
+		KeyIndex:  -1,
+		Retryable: s.Code() == codes.Aborted || s.Code() == codes.Unavailable,
+	}
+	for _, d := range s.Details() {
+		if d, ok := d.(*ErrorDetail); ok {
+			e.KeyIndex = int(d.KeyIndex)
+			e.Retryable = d.Retryable
+		}
+	}
+	return e, true
+}
+
+// KeyIndex returns the index of the key which caused the error, -1 when the
+// error isn't about a single key
+func KeyIndex(err error) int {
+	if e, ok := AsError(err); ok {
+		return e.KeyIndex
+	}
+	return -1
+}
+
+// IsRetryable reports whether retrying the same call may succeed, such as
+// after a conflict, a rate limit or while the database is unavailable
+func IsRetryable(err error) bool {
+	e, ok := AsError(err)
+	return ok && e.Retryable
+}
+
+// IsInvalid reports whether the request was rejected as invalid
+func IsInvalid(err error) bool {
+	return status.Code(err) == codes.InvalidArgument
+}
+
+// IsConflict reports whether the transaction conflicted with another one
+func IsConflict(err error) bool {
+	return status.Code(err) == codes.Aborted
+}
+
+// IsOverLimit reports whether the request was over a limit of the server, such
+// as a quota, a rate limit or the transaction size
+func IsOverLimit(err error) bool {
+	return status.Code(err) == codes.ResourceExhausted
+}
+
+// IsUnavailable reports whether the server or the database couldn't serve the
+// request
+func IsUnavailable(err error) bool {
+	return status.Code(err) == codes.Unavailable
+}
+
+// IsNotFound reports whether the database, the bucket or the token of the
+// request doesn't exist
+func IsNotFound(err error) bool {
+	return status.Code(err) == codes.NotFound
+}
+
+// IsPermissionDenied reports whether the caller isn't allowed to make the
+// request
+func IsPermissionDenied(err error) bool {
+	return status.Code(err) == codes.PermissionDenied
+}
@@ -0,0 +1,73 @@
+package kvrpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// traceparentHeader is the metadata key of the W3C trace context
+const traceparentHeader = "traceparent"
+
+type traceparentKey struct{}
+
+// WithTraceparent sets the W3C trace context sent along with the calls made
+// with the returned context, so the spans of the server join the trace. Its
+// parent-id is the span of the caller.
+func WithTraceparent(ctx context.Context, traceparent string) context.Context {
+	return context.WithValue(ctx, traceparentKey{}, traceparent)
+}
+
+// NewTraceparent generates the trace context of a new sampled trace
+func NewTraceparent() string {
+	var traceID [16]byte
+	var spanID [8]byte
+	rand.Read(traceID[:])
+	rand.Read(spanID[:])
+	return fmt.Sprintf("00-%x-%x-01", traceID, spanID)
+}
+
+// incomingTraceparent returns the trace context of the incoming call when the
+// client is used by a gRPC server, with a new parent-id for the call of the
+// client. Its version, trace-id and flags are kept.
+func incomingTraceparent(ctx context.Context) (string, bool) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", false
+	}
+	values := md.Get(traceparentHeader)
+	if len(values) == 0 {
+		return "", false
+	}
+	parts := strings.Split(values[0], "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return "", false
+	}
+	var spanID [8]byte
+	rand.Read(spanID[:])
+	parts[2] = hex.EncodeToString(spanID[:])
+	return strings.Join(parts, "-"), true
+}
+
+// traceUnary sends the trace context along with the call: the one set with
+// WithTraceparent or the one of the incoming call when the client is used by a
+// gRPC server. Without either the server starts a trace following its sampling
+// ratio.
+func traceUnary(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if md, ok := metadata.FromOutgoingContext(ctx); ok && len(md.Get(traceparentHeader)) > 0 {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	t, ok := ctx.Value(traceparentKey{}).(string)
+	if !ok || t == "" {
+		t, ok = incomingTraceparent(ctx)
+	}
+	if ok {
+		ctx = metadata.AppendToOutgoingContext(ctx, traceparentHeader, t)
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// badgerMaxKeySize is the largest key Badger accepts, the prefix of the
+// namespace counts towards it
+const badgerMaxKeySize = 65000
+
+// requestLimits bounds the keys and values of a request, the requests over
+// them are rejected as a whole before anything is read or written
+type requestLimits struct {
+	// maxBatchKeys is the maximum number of keys in a request, 0 for no limit
+	maxBatchKeys int
+	maxKeySize   int
+	maxValueSize int64
+}
+
+func (l requestLimits) checkBatch(n int) error {
+	if l.maxBatchKeys > 0 && n > l.maxBatchKeys {
+		return status.Errorf(codes.InvalidArgument, "request has %d keys, over the limit of %d", n, l.maxBatchKeys)
+	}
+	return nil
+}
+
+// checkKey rejects keys which can't be stored in the keyspace
+func (l requestLimits) checkKey(ks keyspace, i int, key []byte) error {
+	if len(key) == 0 {
+		return keyStatusf(codes.InvalidArgument, i, "key %d is empty", i)
+	}
+	if err := ks.check(i, key); err != nil {
+		return err
+	}
+	max := l.maxKeySize
+	if m := badgerMaxKeySize - len(ks.prefix); m < max {
+		max = m
+	}
+	if len(key) > max {
+		return keyStatusf(codes.InvalidArgument, i, "key %d is %d bytes, over the limit of %d", i, len(key), max)
+	}
+	return nil
+}
+
+func (l requestLimits) checkValue(i int, value []byte) error {
+	if int64(len(value)) > l.maxValueSize {
+		return keyStatusf(codes.InvalidArgument, i, "value %d is %d bytes, over the limit of %d", i, len(value), l.maxValueSize)
+	}
+	return nil
+}
+
+// checkKeys checks the number of keys and every key of a request
+func (l requestLimits) checkKeys(ks keyspace, keys [][]byte) error {
+	if err := l.checkBatch(len(keys)); err != nil {
+		return err
+	}
+	for i, key := range keys {
+		if err := l.checkKey(ks, i, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
@@ -10,6 +11,8 @@ import (
 	"github.com/rs/zerolog/log"
 	"github.com/yndc/kvrpc/pb"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 func main() {
@@ -20,13 +23,50 @@ func main() {
 		log.Fatal().Err(err).Msgf("failed to create listener")
 	}
 
-	grpcServer := grpc.NewServer(grpc.MaxRecvMsgSize(1_000_000_000))
 	kvrpcService := NewService(config)
+	serverOptions := []grpc.ServerOption{
+		grpc.MaxRecvMsgSize(int(config.maxMessageSize)),
+		grpc.ChainUnaryInterceptor(
+			kvrpcService.traceUnary,
+			kvrpcService.metricsUnary,
+			kvrpcService.slowUnary,
+			kvrpcService.errorsUnary,
+			kvrpcService.deadlineUnary,
+			kvrpcService.authenticateUnary,
+			kvrpcService.auditUnary,
+			kvrpcService.limitUnary,
+		),
+		grpc.ChainStreamInterceptor(
+			kvrpcService.errorsStream,
+			kvrpcService.authenticateStream,
+			kvrpcService.limitStream,
+		),
+	}
+	if config.tlsCert != "" {
+		certs, err := newCertReloader(config.tlsCert, config.tlsKey, config.tlsClientCA)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to load the TLS certificate")
+		}
+		serverOptions = append(serverOptions, grpc.Creds(credentials.NewTLS(certs.serverConfig())))
+	}
+	grpcServer := grpc.NewServer(serverOptions...)
 	pb.RegisterKVRPCServer(grpcServer, kvrpcService)
+	healthChecker := newHealthChecker(kvrpcService, config.healthInterval)
+	healthpb.RegisterHealthServer(grpcServer, healthChecker)
+	go healthChecker.run()
 
 	signalChan := make(chan os.Signal, 1)
 	fatalChan := make(chan error, 1)
 
+	if config.metricsAddress != "" {
+		go func() {
+			log.Info().Msgf("serving metrics at %s", config.metricsAddress)
+			if err := http.ListenAndServe(config.metricsAddress, kvrpcService.metricsHandler()); err != nil {
+				fatalChan <- err
+			}
+		}()
+	}
+
 	go func() {
 		log.Info().Msgf("running at port %d", config.port)
 		if err := grpcServer.Serve(lis); err != nil {
@@ -43,13 +83,17 @@ func main() {
 		syscall.SIGKILL,
 	)
 
+	// a second signal terminates without waiting for the shutdown
 	exit := func(code int) {
 		go func() {
 			<-signalChan
 			log.Fatal().Msg("terminated forcefully")
 		}()
 
-		kvrpcService.Close()
+		if shutdown(grpcServer, healthChecker, kvrpcService, config.drainDelay, config.shutdownTimeout) != 0 {
+			code = 1
+		}
+		log.Info().Int("code", code).Msg("shut down")
 		os.Exit(code)
 	}
 
@@ -58,7 +102,7 @@ func main() {
 		log.Info().Msg("shutting down gracefully")
 		exit(0)
 	case err := <-fatalChan:
-		log.Fatal().Err(err).Msg("fatal error")
+		log.Error().Err(err).Msg("fatal error")
 		exit(1)
 	}
 }
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	context "context"
+	"expvar"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yndc/kvrpc/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// durationBuckets are the upper bounds of the latency histograms in seconds
+var durationBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// batchBuckets are the upper bounds of the histograms of keys per request
+var batchBuckets = []float64{1, 10, 100, 1000, 10000, 100000}
+
+// badgerMapLabels are the labels of the keys of the map metrics of Badger
+var badgerMapLabels = map[string]string{
+	"badger_v3_lsm_level_gets_total": "level",
+	"badger_v3_lsm_bloom_hits_total": "level",
+}
+
+type histogram struct {
+	bounds []float64
+	// counts has a count per bucket and the count over the last bound
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	h.counts[sort.SearchFloat64s(h.bounds, v)]++
+	h.sum += v
+	h.count++
+}
+
+type callLabels struct {
+	method string
+	code   string
+}
+
+// metrics collects the metrics of the calls served, they're written in the
+// Prometheus text format along with the ones of the databases
+type metrics struct {
+	mu        sync.Mutex
+	calls     map[callLabels]uint64
+	durations map[string]*histogram
+	batches   map[string]*histogram
+	received  map[string]uint64
+	sent      map[string]uint64
+	// auditFailures counts the audit records which failed to be written
+	auditFailures uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		calls:     make(map[callLabels]uint64),
+		durations: make(map[string]*histogram),
+		batches:   make(map[string]*histogram),
+		received:  make(map[string]uint64),
+		sent:      make(map[string]uint64),
+	}
+}
+
+// batchSize returns the number of keys of the requests working on a batch
+func batchSize(req interface{}) (int, bool) {
+	switch req := req.(type) {
+	case *pb.SetRequest:
+		return len(req.Values), true
+	case *pb.GetRequest:
+		return len(req.Keys), true
+	case *pb.DelRequest:
+		return len(req.Keys), true
+	}
+	return 0, false
+}
+
+func messageSize(m interface{}) int {
+	if m, ok := m.(proto.Message); ok {
+		return proto.Size(m)
+	}
+	return 0
+}
+
+func (m *metrics) observe(fullMethod string, err error, elapsed time.Duration, req, res interface{}) {
+	method := fullMethod[strings.LastIndex(fullMethod, "/")+1:]
+	received, sent := messageSize(req), 0
+	if err == nil {
+		sent = messageSize(res)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls[callLabels{method, status.Code(err).String()}]++
+	h, ok := m.durations[method]
+	if !ok {
+		h = newHistogram(durationBuckets)
+		m.durations[method] = h
+	}
+	h.observe(elapsed.Seconds())
+	if n, ok := batchSize(req); ok {
+		h, ok := m.batches[method]
+		if !ok {
+			h = newHistogram(batchBuckets)
+			m.batches[method] = h
+		}
+		h.observe(float64(n))
+	}
+	m.received[method] += uint64(received)
+	m.sent[method] += uint64(sent)
+}
+
+// auditFailed counts an audit record which couldn't be written
+func (m *metrics) auditFailed() {
+	m.mu.Lock()
+	m.auditFailures++
+	m.mu.Unlock()
+}
+
+// metricsUnary records the unary calls
+func (s *Service) metricsUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	res, err := handler(ctx, req)
+	s.metrics.observe(info.FullMethod, err, time.Since(start), req, res)
+	return res, err
+}
+
+// labelEscaper escapes label values as the text format expects
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricsWriter writes metrics in the Prometheus text format
+type metricsWriter struct {
+	w io.Writer
+}
+
+func (m metricsWriter) header(name, kind, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes a sample, labels is a list of label names and values
+func (m metricsWriter) sample(name string, value float64, labels ...string) {
+	fmt.Fprint(m.w, name)
+	if len(labels) > 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for i := 0; i < len(labels); i += 2 {
+			pairs = append(pairs, labels[i]+`="`+labelEscaper.Replace(labels[i+1])+`"`)
+		}
+		fmt.Fprintf(m.w, "{%s}", strings.Join(pairs, ","))
+	}
+	fmt.Fprintf(m.w, " %s\n", formatSample(value))
+}
+
+func (m metricsWriter) histogram(name string, h *histogram, labels ...string) {
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		m.sample(name+"_bucket", float64(cumulative), append(labels, "le", formatSample(bound))...)
+	}
+	m.sample(name+"_bucket", float64(h.count), append(labels, "le", "+Inf")...)
+	m.sample(name+"_sum", h.sum, labels...)
+	m.sample(name+"_count", float64(h.count), labels...)
+}
+
+func formatSample(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedHistograms(m map[string]*histogram) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeMetrics writes the metrics of the calls, of the databases and the
+// expvar metrics of Badger
+func (s *Service) writeMetrics(w io.Writer) {
+	// the metrics of the calls are rendered under the lock taken by every
+	// call, so a slow scraper doesn't hold it
+	var buf bytes.Buffer
+	m := metricsWriter{&buf}
+	s.metrics.mu.Lock()
+	calls := make([]callLabels, 0, len(s.metrics.calls))
+	for l := range s.metrics.calls {
+		calls = append(calls, l)
+	}
+	sort.Slice(calls, func(i, j int) bool {
+		if calls[i].method != calls[j].method {
+			return calls[i].method < calls[j].method
+		}
+		return calls[i].code < calls[j].code
+	})
+	m.header("kvrpc_requests_total", "counter", "Calls served by method and status code.")
+	for _, l := range calls {
+		m.sample("kvrpc_requests_total", float64(s.metrics.calls[l]), "method", l.method, "code", l.code)
+	}
+	m.header("kvrpc_request_duration_seconds", "histogram", "Latency of the calls by method.")
+	for _, method := range sortedHistograms(s.metrics.durations) {
+		m.histogram("kvrpc_request_duration_seconds", s.metrics.durations[method], "method", method)
+	}
+	m.header("kvrpc_batch_keys", "histogram", "Keys per request of the batch methods.")
+	for _, method := range sortedHistograms(s.metrics.batches) {
+		m.histogram("kvrpc_batch_keys", s.metrics.batches[method], "method", method)
+	}
+	m.header("kvrpc_received_bytes_total", "counter", "Size of the request messages by method.")
+	for _, method := range sortedKeys(s.metrics.received) {
+		m.sample("kvrpc_received_bytes_total", float64(s.metrics.received[method]), "method", method)
+	}
+	m.header("kvrpc_sent_bytes_total", "counter", "Size of the response messages by method.")
+	for _, method := range sortedKeys(s.metrics.sent) {
+		m.sample("kvrpc_sent_bytes_total", float64(s.metrics.sent[method]), "method", method)
+	}
+	m.header("kvrpc_audit_write_failures_total", "counter", "Audit records which failed to be written.")
+	m.sample("kvrpc_audit_write_failures_total", float64(s.metrics.auditFailures))
+	s.metrics.mu.Unlock()
+	w.Write(buf.Bytes())
+
+	m = metricsWriter{w}
+	s.writeDatabaseMetrics(m)
+	writeBadgerMetrics(m)
+}
+
+// writeDatabaseMetrics writes the sizes and the cache metrics of the open
+// databases
+func (s *Service) writeDatabaseMetrics(m metricsWriter) {
+	s.dbsMu.RLock()
+	names := make([]string, 0, len(s.dbs))
+	for name := range s.dbs {
+		names = append(names, name)
+	}
+	s.dbsMu.RUnlock()
+	sort.Strings(names)
+
+	type sample struct {
+		name  string
+		value float64
+	}
+	samples := make(map[string][]sample)
+	for _, name := range names {
+		d, release, err := s.database(name)
+		if err != nil {
+			continue
+		}
+		lsm, vlog := d.db.Size()
+		block, index := d.db.BlockCacheMetrics(), d.db.IndexCacheMetrics()
+		release()
+		add := func(metric string, value float64) {
+			samples[metric] = append(samples[metric], sample{name, value})
+		}
+		add("kvrpc_database_lsm_size_bytes", float64(lsm))
+		add("kvrpc_database_vlog_size_bytes", float64(vlog))
+		add("kvrpc_database_block_cache_hits_total", float64(block.Hits()))
+		add("kvrpc_database_block_cache_misses_total", float64(block.Misses()))
+		add("kvrpc_database_index_cache_hits_total", float64(index.Hits()))
+		add("kvrpc_database_index_cache_misses_total", float64(index.Misses()))
+	}
+
+	for _, metric := range []struct{ name, kind, help string }{
+		{"kvrpc_database_lsm_size_bytes", "gauge", "Size of the LSM tree of the database."},
+		{"kvrpc_database_vlog_size_bytes", "gauge", "Size of the value log of the database."},
+		{"kvrpc_database_block_cache_hits_total", "counter", "Hits of the block cache of the database."},
+		{"kvrpc_database_block_cache_misses_total", "counter", "Misses of the block cache of the database."},
+		{"kvrpc_database_index_cache_hits_total", "counter", "Hits of the index cache of the database."},
+		{"kvrpc_database_index_cache_misses_total", "counter", "Misses of the index cache of the database."},
+	} {
+		m.header(metric.name, metric.kind, metric.help)
+		for _, v := range samples[metric.name] {
+			m.sample(metric.name, v.value, "database", v.name)
+		}
+	}
+}
+
+// writeBadgerMetrics writes the expvar metrics of Badger, which are shared by
+// every database of the process
+func writeBadgerMetrics(m metricsWriter) {
+	expvar.Do(func(kv expvar.KeyValue) {
+		if !strings.HasPrefix(kv.Key, "badger_") {
+			return
+		}
+		kind := "gauge"
+		if strings.HasSuffix(kv.Key, "_total") {
+			kind = "counter"
+		}
+		switch v := kv.Value.(type) {
+		case *expvar.Int:
+			m.header(kv.Key, kind, "Badger expvar "+kv.Key+".")
+			m.sample(kv.Key, float64(v.Value()))
+		case *expvar.Map:
+			label, ok := badgerMapLabels[kv.Key]
+			if !ok {
+				label = "dir"
+			}
+			m.header(kv.Key, kind, "Badger expvar "+kv.Key+".")
+			v.Do(func(e expvar.KeyValue) {
+				if n, ok := e.Value.(*expvar.Int); ok {
+					m.sample(kv.Key, float64(n.Value()), label, e.Key)
+				}
+			})
+		}
+	})
+}
+
+// metricsHandler serves the metrics at /metrics
+func (s *Service) metricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		s.writeMetrics(w)
+	})
+	return mux
+}
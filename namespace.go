@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	context "context"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/yndc/kvrpc/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// reservedPrefix marks the part of the keyspace used by the server itself,
+// keys under it can't be accessed through the default namespace
+var reservedPrefix = []byte("\x00kvrpc\x00")
+
+var bucketsPrefix = reservedKey("bucket")
+
+// namePattern restricts the names of buckets and databases
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// reservedKey builds a key inside the reserved keyspace
+func reservedKey(parts ...string) []byte {
+	key := append([]byte{}, reservedPrefix...)
+	for _, p := range parts {
+		key = append(key, p...)
+		key = append(key, 0)
+	}
+	return key
+}
+
+// bucket is a registered bucket, the requests hold mu for reading while they
+// use its keyspace so dropping it waits for their writes to commit
+type bucket struct {
+	info *pb.Bucket
+	// dropping is set while the bucket is dropped, it's guarded by bucketsMu
+	// of the database
+	dropping bool
+
+	mu      sync.RWMutex
+	dropped bool
+}
+
+// keyspace maps the keys of a namespace into the underlying database
+type keyspace struct {
+	prefix []byte
+}
+
+func (k keyspace) key(key []byte) []byte {
+	if len(k.prefix) == 0 {
+		return key
+	}
+	dst := make([]byte, 0, len(k.prefix)+len(key))
+	dst = append(dst, k.prefix...)
+	return append(dst, key...)
+}
+
+// reserved reports whether the key belongs to the server instead of the keyspace
+func (k keyspace) reserved(key []byte) bool {
+	return len(k.prefix) == 0 && bytes.HasPrefix(key, reservedPrefix)
+}
+
+// check rejects keys which can't be used in the keyspace
+func (k keyspace) check(i int, key []byte) error {
+	if k.reserved(key) {
+		return keyStatusf(codes.InvalidArgument, i, "key %d uses the reserved prefix", i)
+	}
+	return nil
+}
+
+func namespaceKeyspace(name string) keyspace {
+	return keyspace{prefix: reservedKey("ns", name)}
+}
+
+// loadBuckets reads the bucket registry from the database
+func (d *database) loadBuckets() error {
+	buckets := make(map[string]*bucket)
+	if !d.iterable(bucketsPrefix) {
+		d.buckets = buckets
+		return nil
+	}
+	err := d.db.View(func(txn *badger.Txn) error {
+		opt := badger.DefaultIteratorOptions
+		opt.Prefix = bucketsPrefix
+		it := txn.NewIterator(opt)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			info := &pb.Bucket{}
+			err := it.Item().Value(func(val []byte) error {
+				return proto.Unmarshal(val, info)
+			})
+			if err != nil {
+				return err
+			}
+			buckets[info.Name] = &bucket{info: info}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	d.bucketsMu.Lock()
+	d.buckets = buckets
+	d.bucketsMu.Unlock()
+	return nil
+}
+
+// namespace resolves the keyspace of the given namespace, the empty name is
+// the default namespace. The bucket can't be dropped until the returned
+// function is called.
+func (d *database) namespace(name string) (keyspace, func(), error) {
+	if name == "" {
+		return keyspace{}, func() {}, nil
+	}
+	d.bucketsMu.RLock()
+	b, ok := d.buckets[name]
+	ok = ok && !b.dropping
+	d.bucketsMu.RUnlock()
+	if ok {
+		b.mu.RLock()
+		if !b.dropped {
+			return namespaceKeyspace(name), b.mu.RUnlock, nil
+		}
+		b.mu.RUnlock()
+	}
+	return keyspace{}, nil, status.Errorf(codes.NotFound, "bucket %q does not exist", name)
+}
+
+// keyspace acquires the database and resolves the namespace of a request, the
+// returned function must be called once the request is done
+func (s *Service) keyspace(database, namespace string) (*database, keyspace, func(), error) {
+	d, release, err := s.database(database)
+	if err != nil {
+		return nil, keyspace{}, nil, err
+	}
+	ks, unlock, err := d.namespace(namespace)
+	if err != nil {
+		release()
+		return nil, keyspace{}, nil, err
+	}
+	return d, ks, func() {
+		unlock()
+		release()
+	}, nil
+}
+
+// CreateBucket creates a new namespace with an isolated keyspace
+func (s *Service) CreateBucket(ctx context.Context, in *pb.CreateBucketRequest) (*pb.Bucket, error) {
+	if !namePattern.MatchString(in.Name) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid bucket name %q", in.Name)
+	}
+	if err := s.authorizeAdmin(ctx, in.Database, in.Name); err != nil {
+		return nil, err
+	}
+	d, release, err := s.database(in.Database)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if err := d.writable(); err != nil {
+		return nil, err
+	}
+
+	request, err := newIdempotencyKey(ctx, "CreateBucket", in.Name, in.RequestId, in)
+	if err != nil {
+		return nil, err
+	}
+	d.bucketsMu.Lock()
+	defer d.bucketsMu.Unlock()
+	info := &pb.Bucket{}
+	if ok, err := s.recorded(d, request, info); ok || err != nil {
+		return info, err
+	}
+	if b, ok := d.buckets[in.Name]; ok {
+		if b.dropping {
+			return nil, status.Errorf(codes.Unavailable, "bucket %q is being dropped", in.Name)
+		}
+		return nil, status.Errorf(codes.AlreadyExists, "bucket %q already exists", in.Name)
+	}
+
+	info = &pb.Bucket{
+		Name:      in.Name,
+		CreatedAt: time.Now().Unix(),
+	}
+	val, err := proto.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	err = d.db.Update(func(txn *badger.Txn) error {
+		if err := txn.Set(reservedKey("bucket", in.Name), val); err != nil {
+			return err
+		}
+		return s.record(txn, request, info)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	d.buckets[in.Name] = &bucket{info: info}
+	return info, nil
+}
+
+// ListBuckets returns the existing buckets the caller has rules for sorted by
+// name, a principal bound to a tenant only sees the bucket of the tenant
+func (s *Service) ListBuckets(ctx context.Context, in *pb.ListBucketsRequest) (*pb.ListBucketsResponse, error) {
+	d, release, err := s.database(in.Database)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var tenant string
+	if p := principalFrom(ctx); p != nil {
+		tenant = p.tenant
+	}
+	d.bucketsMu.RLock()
+	buckets := make([]*pb.Bucket, 0, len(d.buckets))
+	for name, b := range d.buckets {
+		if !b.dropping && (tenant == "" || name == tenant) && s.listable(ctx, in.Database, name) {
+			buckets = append(buckets, b.info)
+		}
+	}
+	d.bucketsMu.RUnlock()
+
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].Name < buckets[j].Name
+	})
+	return &pb.ListBucketsResponse{
+		Buckets: buckets,
+	}, nil
+}
+
+// DropBucket deletes a bucket along with all of its data
+func (s *Service) DropBucket(ctx context.Context, in *pb.DropBucketRequest) (*pb.Empty, error) {
+	if err := s.authorizeAdmin(ctx, in.Database, in.Name); err != nil {
+		return nil, err
+	}
+	d, release, err := s.database(in.Database)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if err := d.writable(); err != nil {
+		return nil, err
+	}
+
+	request, err := newIdempotencyKey(ctx, "DropBucket", in.Name, in.RequestId, in)
+	if err != nil {
+		return nil, err
+	}
+	d.bucketsMu.Lock()
+	if ok, err := s.recorded(d, request, &pb.Empty{}); ok || err != nil {
+		d.bucketsMu.Unlock()
+		return &pb.Empty{}, err
+	}
+	b, ok := d.buckets[in.Name]
+	if !ok {
+		d.bucketsMu.Unlock()
+		return nil, status.Errorf(codes.NotFound, "bucket %q does not exist", in.Name)
+	}
+	if b.dropping {
+		d.bucketsMu.Unlock()
+		return nil, status.Errorf(codes.Unavailable, "bucket %q is being dropped", in.Name)
+	}
+	// the dropping bucket stays registered so it can't be created again
+	// until it's gone, the requests for the other buckets don't wait for it
+	b.dropping = true
+	d.bucketsMu.Unlock()
+	restore := func() {
+		b.mu.Lock()
+		b.dropped = false
+		b.mu.Unlock()
+		d.bucketsMu.Lock()
+		b.dropping = false
+		d.bucketsMu.Unlock()
+	}
+
+	// the writes in flight into the bucket are committed before its keyspace
+	// is dropped, the later ones find it dropped
+	b.mu.Lock()
+	b.dropped = true
+	b.mu.Unlock()
+
+	// the data is dropped before the registry entry, so a crash in between
+	// leaves an empty bucket instead of data for a bucket created again
+	if err := d.db.DropPrefix(namespaceKeyspace(in.Name).prefix); err != nil {
+		restore()
+		return nil, err
+	}
+	err = d.db.Update(func(txn *badger.Txn) error {
+		if err := txn.Delete(reservedKey("bucket", in.Name)); err != nil {
+			return err
+		}
+		if err := txn.Delete(quotaKey(in.Name)); err != nil {
+			return err
+		}
+		return s.record(txn, request, &pb.Empty{})
+	})
+	if err != nil {
+		// the bucket is kept empty, its usage is counted again
+		if q := d.namespaceQuota(in.Name); q != nil {
+			d.count(q)
+		}
+		restore()
+		return nil, err
+	}
+	d.bucketsMu.Lock()
+	delete(d.buckets, in.Name)
+	d.bucketsMu.Unlock()
+	d.quotasMu.Lock()
+	delete(d.quotas, in.Name)
+	d.quotasMu.Unlock()
+	return &pb.Empty{}, nil
+}
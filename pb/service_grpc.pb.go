@@ -21,6 +21,21 @@ type KVRPCClient interface {
 	Set(ctx context.Context, in *SetRequest, opts ...grpc.CallOption) (*SetResponse, error)
 	Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error)
 	Del(ctx context.Context, in *DelRequest, opts ...grpc.CallOption) (*Empty, error)
+	Scan(ctx context.Context, in *ScanRequest, opts ...grpc.CallOption) (*ScanResponse, error)
+	List(ctx context.Context, in *ScanRequest, opts ...grpc.CallOption) (*ListResponse, error)
+	Aggregate(ctx context.Context, in *AggregateRequest, opts ...grpc.CallOption) (*AggregateResponse, error)
+	CreateBucket(ctx context.Context, in *CreateBucketRequest, opts ...grpc.CallOption) (*Bucket, error)
+	ListBuckets(ctx context.Context, in *ListBucketsRequest, opts ...grpc.CallOption) (*ListBucketsResponse, error)
+	DropBucket(ctx context.Context, in *DropBucketRequest, opts ...grpc.CallOption) (*Empty, error)
+	OpenDatabase(ctx context.Context, in *OpenDatabaseRequest, opts ...grpc.CallOption) (*Database, error)
+	CloseDatabase(ctx context.Context, in *CloseDatabaseRequest, opts ...grpc.CallOption) (*Empty, error)
+	ListDatabases(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*ListDatabasesResponse, error)
+	RevokeToken(ctx context.Context, in *RevokeTokenRequest, opts ...grpc.CallOption) (*Empty, error)
+	SetAccessRules(ctx context.Context, in *PrincipalRules, opts ...grpc.CallOption) (*Empty, error)
+	ListAccessRules(ctx context.Context, in *ListAccessRulesRequest, opts ...grpc.CallOption) (*ListAccessRulesResponse, error)
+	SetQuota(ctx context.Context, in *Quota, opts ...grpc.CallOption) (*Empty, error)
+	GetUsage(ctx context.Context, in *GetUsageRequest, opts ...grpc.CallOption) (*GetUsageResponse, error)
+	ListSlowRequests(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*ListSlowRequestsResponse, error)
 }
 
 type kVRPCClient struct {
@@ -67,6 +82,141 @@ func (c *kVRPCClient) Del(ctx context.Context, in *DelRequest, opts ...grpc.Call
 	return out, nil
 }
 
+func (c *kVRPCClient) Scan(ctx context.Context, in *ScanRequest, opts ...grpc.CallOption) (*ScanResponse, error) {
+	out := new(ScanResponse)
+	err := c.cc.Invoke(ctx, "/pb.KVRPC/Scan", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVRPCClient) List(ctx context.Context, in *ScanRequest, opts ...grpc.CallOption) (*ListResponse, error) {
+	out := new(ListResponse)
+	err := c.cc.Invoke(ctx, "/pb.KVRPC/List", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVRPCClient) Aggregate(ctx context.Context, in *AggregateRequest, opts ...grpc.CallOption) (*AggregateResponse, error) {
+	out := new(AggregateResponse)
+	err := c.cc.Invoke(ctx, "/pb.KVRPC/Aggregate", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVRPCClient) CreateBucket(ctx context.Context, in *CreateBucketRequest, opts ...grpc.CallOption) (*Bucket, error) {
+	out := new(Bucket)
+	err := c.cc.Invoke(ctx, "/pb.KVRPC/CreateBucket", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVRPCClient) ListBuckets(ctx context.Context, in *ListBucketsRequest, opts ...grpc.CallOption) (*ListBucketsResponse, error) {
+	out := new(ListBucketsResponse)
+	err := c.cc.Invoke(ctx, "/pb.KVRPC/ListBuckets", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVRPCClient) DropBucket(ctx context.Context, in *DropBucketRequest, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, "/pb.KVRPC/DropBucket", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVRPCClient) OpenDatabase(ctx context.Context, in *OpenDatabaseRequest, opts ...grpc.CallOption) (*Database, error) {
+	out := new(Database)
+	err := c.cc.Invoke(ctx, "/pb.KVRPC/OpenDatabase", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVRPCClient) CloseDatabase(ctx context.Context, in *CloseDatabaseRequest, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, "/pb.KVRPC/CloseDatabase", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVRPCClient) ListDatabases(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*ListDatabasesResponse, error) {
+	out := new(ListDatabasesResponse)
+	err := c.cc.Invoke(ctx, "/pb.KVRPC/ListDatabases", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVRPCClient) RevokeToken(ctx context.Context, in *RevokeTokenRequest, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, "/pb.KVRPC/RevokeToken", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVRPCClient) SetAccessRules(ctx context.Context, in *PrincipalRules, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, "/pb.KVRPC/SetAccessRules", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVRPCClient) ListAccessRules(ctx context.Context, in *ListAccessRulesRequest, opts ...grpc.CallOption) (*ListAccessRulesResponse, error) {
+	out := new(ListAccessRulesResponse)
+	err := c.cc.Invoke(ctx, "/pb.KVRPC/ListAccessRules", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVRPCClient) SetQuota(ctx context.Context, in *Quota, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, "/pb.KVRPC/SetQuota", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVRPCClient) GetUsage(ctx context.Context, in *GetUsageRequest, opts ...grpc.CallOption) (*GetUsageResponse, error) {
+	out := new(GetUsageResponse)
+	err := c.cc.Invoke(ctx, "/pb.KVRPC/GetUsage", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVRPCClient) ListSlowRequests(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*ListSlowRequestsResponse, error) {
+	out := new(ListSlowRequestsResponse)
+	err := c.cc.Invoke(ctx, "/pb.KVRPC/ListSlowRequests", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // KVRPCServer is the server API for KVRPC service.
 // All implementations must embed UnimplementedKVRPCServer
 // for forward compatibility
@@ -75,6 +225,21 @@ type KVRPCServer interface {
 	Set(context.Context, *SetRequest) (*SetResponse, error)
 	Get(context.Context, *GetRequest) (*GetResponse, error)
 	Del(context.Context, *DelRequest) (*Empty, error)
+	Scan(context.Context, *ScanRequest) (*ScanResponse, error)
+	List(context.Context, *ScanRequest) (*ListResponse, error)
+	Aggregate(context.Context, *AggregateRequest) (*AggregateResponse, error)
+	CreateBucket(context.Context, *CreateBucketRequest) (*Bucket, error)
+	ListBuckets(context.Context, *ListBucketsRequest) (*ListBucketsResponse, error)
+	DropBucket(context.Context, *DropBucketRequest) (*Empty, error)
+	OpenDatabase(context.Context, *OpenDatabaseRequest) (*Database, error)
+	CloseDatabase(context.Context, *CloseDatabaseRequest) (*Empty, error)
+	ListDatabases(context.Context, *Empty) (*ListDatabasesResponse, error)
+	RevokeToken(context.Context, *RevokeTokenRequest) (*Empty, error)
+	SetAccessRules(context.Context, *PrincipalRules) (*Empty, error)
+	ListAccessRules(context.Context, *ListAccessRulesRequest) (*ListAccessRulesResponse, error)
+	SetQuota(context.Context, *Quota) (*Empty, error)
+	GetUsage(context.Context, *GetUsageRequest) (*GetUsageResponse, error)
+	ListSlowRequests(context.Context, *Empty) (*ListSlowRequestsResponse, error)
 	mustEmbedUnimplementedKVRPCServer()
 }
 
@@ -94,6 +259,51 @@ func (UnimplementedKVRPCServer) Get(context.Context, *GetRequest) (*GetResponse,
 func (UnimplementedKVRPCServer) Del(context.Context, *DelRequest) (*Empty, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Del not implemented")
 }
+func (UnimplementedKVRPCServer) Scan(context.Context, *ScanRequest) (*ScanResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Scan not implemented")
+}
+func (UnimplementedKVRPCServer) List(context.Context, *ScanRequest) (*ListResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method List not implemented")
+}
+func (UnimplementedKVRPCServer) Aggregate(context.Context, *AggregateRequest) (*AggregateResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Aggregate not implemented")
+}
+func (UnimplementedKVRPCServer) CreateBucket(context.Context, *CreateBucketRequest) (*Bucket, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateBucket not implemented")
+}
+func (UnimplementedKVRPCServer) ListBuckets(context.Context, *ListBucketsRequest) (*ListBucketsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListBuckets not implemented")
+}
+func (UnimplementedKVRPCServer) DropBucket(context.Context, *DropBucketRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DropBucket not implemented")
+}
+func (UnimplementedKVRPCServer) OpenDatabase(context.Context, *OpenDatabaseRequest) (*Database, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method OpenDatabase not implemented")
+}
+func (UnimplementedKVRPCServer) CloseDatabase(context.Context, *CloseDatabaseRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CloseDatabase not implemented")
+}
+func (UnimplementedKVRPCServer) ListDatabases(context.Context, *Empty) (*ListDatabasesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListDatabases not implemented")
+}
+func (UnimplementedKVRPCServer) RevokeToken(context.Context, *RevokeTokenRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RevokeToken not implemented")
+}
+func (UnimplementedKVRPCServer) SetAccessRules(context.Context, *PrincipalRules) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetAccessRules not implemented")
+}
+func (UnimplementedKVRPCServer) ListAccessRules(context.Context, *ListAccessRulesRequest) (*ListAccessRulesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListAccessRules not implemented")
+}
+func (UnimplementedKVRPCServer) SetQuota(context.Context, *Quota) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetQuota not implemented")
+}
+func (UnimplementedKVRPCServer) GetUsage(context.Context, *GetUsageRequest) (*GetUsageResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetUsage not implemented")
+}
+func (UnimplementedKVRPCServer) ListSlowRequests(context.Context, *Empty) (*ListSlowRequestsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListSlowRequests not implemented")
+}
 func (UnimplementedKVRPCServer) mustEmbedUnimplementedKVRPCServer() {}
 
 // UnsafeKVRPCServer may be embedded to opt out of forward compatibility for this service.
@@ -179,6 +389,276 @@ func _KVRPC_Del_Handler(srv interface{}, ctx context.Context, dec func(interface
 	return interceptor(ctx, in, info, handler)
 }
 
+func _KVRPC_Scan_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ScanRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVRPCServer).Scan(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.KVRPC/Scan",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVRPCServer).Scan(ctx, req.(*ScanRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KVRPC_List_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ScanRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVRPCServer).List(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.KVRPC/List",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVRPCServer).List(ctx, req.(*ScanRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KVRPC_Aggregate_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AggregateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVRPCServer).Aggregate(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.KVRPC/Aggregate",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVRPCServer).Aggregate(ctx, req.(*AggregateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KVRPC_CreateBucket_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateBucketRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVRPCServer).CreateBucket(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.KVRPC/CreateBucket",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVRPCServer).CreateBucket(ctx, req.(*CreateBucketRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KVRPC_ListBuckets_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListBucketsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVRPCServer).ListBuckets(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.KVRPC/ListBuckets",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVRPCServer).ListBuckets(ctx, req.(*ListBucketsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KVRPC_DropBucket_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DropBucketRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVRPCServer).DropBucket(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.KVRPC/DropBucket",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVRPCServer).DropBucket(ctx, req.(*DropBucketRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KVRPC_OpenDatabase_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(OpenDatabaseRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVRPCServer).OpenDatabase(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.KVRPC/OpenDatabase",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVRPCServer).OpenDatabase(ctx, req.(*OpenDatabaseRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KVRPC_CloseDatabase_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CloseDatabaseRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVRPCServer).CloseDatabase(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.KVRPC/CloseDatabase",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVRPCServer).CloseDatabase(ctx, req.(*CloseDatabaseRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KVRPC_ListDatabases_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVRPCServer).ListDatabases(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.KVRPC/ListDatabases",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVRPCServer).ListDatabases(ctx, req.(*Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KVRPC_RevokeToken_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RevokeTokenRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVRPCServer).RevokeToken(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.KVRPC/RevokeToken",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVRPCServer).RevokeToken(ctx, req.(*RevokeTokenRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KVRPC_SetAccessRules_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PrincipalRules)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVRPCServer).SetAccessRules(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.KVRPC/SetAccessRules",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVRPCServer).SetAccessRules(ctx, req.(*PrincipalRules))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KVRPC_ListAccessRules_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListAccessRulesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVRPCServer).ListAccessRules(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.KVRPC/ListAccessRules",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVRPCServer).ListAccessRules(ctx, req.(*ListAccessRulesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KVRPC_SetQuota_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Quota)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVRPCServer).SetQuota(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.KVRPC/SetQuota",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVRPCServer).SetQuota(ctx, req.(*Quota))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KVRPC_GetUsage_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetUsageRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVRPCServer).GetUsage(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.KVRPC/GetUsage",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVRPCServer).GetUsage(ctx, req.(*GetUsageRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KVRPC_ListSlowRequests_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVRPCServer).ListSlowRequests(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.KVRPC/ListSlowRequests",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVRPCServer).ListSlowRequests(ctx, req.(*Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _KVRPC_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "pb.KVRPC",
 	HandlerType: (*KVRPCServer)(nil),
@@ -199,6 +679,66 @@ var _KVRPC_serviceDesc = grpc.ServiceDesc{
 			MethodName: "Del",
 			Handler:    _KVRPC_Del_Handler,
 		},
+		{
+			MethodName: "Scan",
+			Handler:    _KVRPC_Scan_Handler,
+		},
+		{
+			MethodName: "List",
+			Handler:    _KVRPC_List_Handler,
+		},
+		{
+			MethodName: "Aggregate",
+			Handler:    _KVRPC_Aggregate_Handler,
+		},
+		{
+			MethodName: "CreateBucket",
+			Handler:    _KVRPC_CreateBucket_Handler,
+		},
+		{
+			MethodName: "ListBuckets",
+			Handler:    _KVRPC_ListBuckets_Handler,
+		},
+		{
+			MethodName: "DropBucket",
+			Handler:    _KVRPC_DropBucket_Handler,
+		},
+		{
+			MethodName: "OpenDatabase",
+			Handler:    _KVRPC_OpenDatabase_Handler,
+		},
+		{
+			MethodName: "CloseDatabase",
+			Handler:    _KVRPC_CloseDatabase_Handler,
+		},
+		{
+			MethodName: "ListDatabases",
+			Handler:    _KVRPC_ListDatabases_Handler,
+		},
+		{
+			MethodName: "RevokeToken",
+			Handler:    _KVRPC_RevokeToken_Handler,
+		},
+		{
+			MethodName: "SetAccessRules",
+			Handler:    _KVRPC_SetAccessRules_Handler,
+		},
+		{
+			MethodName: "ListAccessRules",
+			Handler:    _KVRPC_ListAccessRules_Handler,
+		},
+		{
+			MethodName: "SetQuota",
+			Handler:    _KVRPC_SetQuota_Handler,
+		},
+		{
+			MethodName: "GetUsage",
+			Handler:    _KVRPC_GetUsage_Handler,
+		},
+		{
+			MethodName: "ListSlowRequests",
+			Handler:    _KVRPC_ListSlowRequests_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "pb/service.proto",
@@ -0,0 +1,262 @@
+package main
+
+import (
+	context "context"
+	"sort"
+	"sync"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/yndc/kvrpc/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// quota is the quota of a namespace along with its usage. The usage is only
+// tracked for the namespaces with a quota, it's counted when the quota is set
+// or the database is opened and updated by the writes.
+type quota struct {
+	limits *pb.Quota
+
+	mu    sync.Mutex
+	bytes int64
+	keys  int64
+}
+
+// usage is the change of the usage made by a write
+type usage struct {
+	bytes int64
+	keys  int64
+}
+
+// track adds the change of replacing the key of the keyspace in txn with a
+// value of the given size, a negative size deletes the key
+func (u *usage) track(txn *badger.Txn, ks keyspace, key []byte, size int64) error {
+	item, err := txn.Get(ks.key(key))
+	switch {
+	case err == nil:
+		u.bytes -= int64(len(key)) + item.ValueSize()
+		u.keys--
+	case err != badger.ErrKeyNotFound:
+		return err
+	}
+	if size >= 0 {
+		u.bytes += int64(len(key)) + size
+		u.keys++
+	}
+	return nil
+}
+
+// checkValue rejects the values over the maximum value size
+func (q *quota) checkValue(i int, size int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if max := q.limits.MaxValueSize; max > 0 && int64(size) > max {
+		return keyStatusf(codes.ResourceExhausted, i, "value %d is %d bytes, over the quota of %d", i, size, max)
+	}
+	return nil
+}
+
+// reserve adds the change to the usage when it keeps the namespace within the
+// quota, changes which don't grow the usage are always allowed. The change is
+// reserved before the write commits so concurrent writes can't exceed the
+// quota together, it's released when the write isn't committed.
+func (q *quota) reserve(u usage) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if max := q.limits.MaxBytes; max > 0 && u.bytes > 0 && q.bytes+u.bytes > max {
+		return status.Errorf(codes.ResourceExhausted, "namespace %q would use %d bytes, over the quota of %d", q.limits.Namespace, q.bytes+u.bytes, max)
+	}
+	if max := q.limits.MaxKeys; max > 0 && u.keys > 0 && q.keys+u.keys > max {
+		return status.Errorf(codes.ResourceExhausted, "namespace %q would have %d keys, over the quota of %d", q.limits.Namespace, q.keys+u.keys, max)
+	}
+	q.bytes += u.bytes
+	q.keys += u.keys
+	return nil
+}
+
+// release takes back a reserved change
+func (q *quota) release(u usage) {
+	q.add(usage{bytes: -u.bytes, keys: -u.keys})
+}
+
+func (q *quota) add(u usage) {
+	q.mu.Lock()
+	q.bytes += u.bytes
+	q.keys += u.keys
+	q.mu.Unlock()
+}
+
+func (q *quota) usage() *pb.Usage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return &pb.Usage{
+		Quota: q.limits,
+		Bytes: q.bytes,
+		Keys:  q.keys,
+	}
+}
+
+func quotaKey(namespace string) []byte {
+	return reservedKey("quota", namespace)
+}
+
+// namespaceQuota returns the quota of the namespace, it's nil without one
+func (d *database) namespaceQuota(namespace string) *quota {
+	d.quotasMu.RLock()
+	defer d.quotasMu.RUnlock()
+	return d.quotas[namespace]
+}
+
+// loadQuotas reads the quotas from the database and counts their usage
+func (d *database) loadQuotas() error {
+	quotas := make(map[string]*quota)
+	prefix := reservedKey("quota")
+	if d.iterable(prefix) {
+		err := d.db.View(func(txn *badger.Txn) error {
+			opt := badger.DefaultIteratorOptions
+			opt.Prefix = prefix
+			it := txn.NewIterator(opt)
+			defer it.Close()
+			for it.Rewind(); it.Valid(); it.Next() {
+				limits := &pb.Quota{}
+				err := it.Item().Value(func(val []byte) error {
+					return proto.Unmarshal(val, limits)
+				})
+				if err != nil {
+					return err
+				}
+				quotas[limits.Namespace] = &quota{limits: limits}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, q := range quotas {
+		if err := d.count(q); err != nil {
+			return err
+		}
+	}
+
+	d.quotasMu.Lock()
+	d.quotas = quotas
+	d.quotasMu.Unlock()
+	return nil
+}
+
+// count sets the usage of the quota from the keys of its namespace
+func (d *database) count(q *quota) error {
+	ks := keyspace{}
+	if q.limits.Namespace != "" {
+		ks = namespaceKeyspace(q.limits.Namespace)
+	}
+	var bytes, keys int64
+	if d.iterable(ks.prefix) {
+		err := d.db.View(func(txn *badger.Txn) error {
+			opt := badger.DefaultIteratorOptions
+			opt.Prefix = ks.prefix
+			opt.PrefetchValues = false
+			it := txn.NewIterator(opt)
+			defer it.Close()
+			for it.Rewind(); it.Valid(); {
+				item := it.Item()
+				if ks.reserved(item.Key()) {
+					it.Seek(reservedEnd)
+					continue
+				}
+				bytes += int64(len(item.Key())-len(ks.prefix)) + item.ValueSize()
+				keys++
+				it.Next()
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	q.mu.Lock()
+	q.bytes, q.keys = bytes, keys
+	q.mu.Unlock()
+	return nil
+}
+
+// SetQuota sets the quota of a namespace, the quotas are stored in the
+// database of the namespace
+func (s *Service) SetQuota(ctx context.Context, in *pb.Quota) (*pb.Empty, error) {
+	if err := requireAdmin(ctx, "setting quotas"); err != nil {
+		return nil, err
+	}
+	if in.MaxBytes < 0 || in.MaxKeys < 0 || in.MaxValueSize < 0 {
+		return nil, status.Error(codes.InvalidArgument, "quota limits must not be negative")
+	}
+	d, _, release, err := s.keyspace(in.Database, in.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if err := d.writable(); err != nil {
+		return nil, err
+	}
+	in.Database = d.config.name
+	unlimited := in.MaxBytes == 0 && in.MaxKeys == 0 && in.MaxValueSize == 0
+	val, err := proto.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+
+	d.quotasMu.Lock()
+	defer d.quotasMu.Unlock()
+	err = d.db.Update(func(txn *badger.Txn) error {
+		if unlimited {
+			return txn.Delete(quotaKey(in.Namespace))
+		}
+		return txn.Set(quotaKey(in.Namespace), val)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if unlimited {
+		delete(d.quotas, in.Namespace)
+	} else if q, ok := d.quotas[in.Namespace]; ok {
+		q.mu.Lock()
+		q.limits = in
+		q.mu.Unlock()
+	} else {
+		q := &quota{limits: in}
+		if err := d.count(q); err != nil {
+			return nil, err
+		}
+		d.quotas[in.Namespace] = q
+	}
+	return &pb.Empty{}, nil
+}
+
+// GetUsage returns the usage of the namespaces with a quota
+func (s *Service) GetUsage(ctx context.Context, in *pb.GetUsageRequest) (*pb.GetUsageResponse, error) {
+	if err := requireAdmin(ctx, "reading the usage"); err != nil {
+		return nil, err
+	}
+	d, release, err := s.database(in.Database)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	d.quotasMu.RLock()
+	usages := make([]*pb.Usage, 0, len(d.quotas))
+	for _, q := range d.quotas {
+		usages = append(usages, q.usage())
+	}
+	d.quotasMu.RUnlock()
+
+	sort.Slice(usages, func(i, j int) bool {
+		return usages[i].Quota.Namespace < usages[j].Quota.Namespace
+	})
+	return &pb.GetUsageResponse{
+		Usage: usages,
+	}, nil
+}
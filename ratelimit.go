@@ -0,0 +1,208 @@
+package main
+
+import (
+	context "context"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// inFlightRetryAfter is the retry hint given when a call is rejected by the
+// in-flight limit, there's no way to tell when a slot frees up
+const inFlightRetryAfter = 100 * time.Millisecond
+
+// limiterSweepInterval is how often the idle buckets are removed
+const limiterSweepInterval = time.Minute
+
+// limitConfig is a rate limit and an in-flight limit applied to the calls
+// grouped by principal, peer address or method. Each group has its own token
+// bucket which holds up to burst tokens and is refilled by rate tokens per
+// second, a zero rate or inFlight disables that limit.
+type limitConfig struct {
+	by string
+	// method limits only the calls of the method when set, either the name
+	// such as Set or the full method name
+	method   string
+	rate     float64
+	burst    int
+	inFlight int
+}
+
+func (c limitConfig) String() string {
+	s := c.by
+	if c.method != "" {
+		s += "@" + c.method
+	}
+	return s
+}
+
+// limiter enforces a limit on the groups of calls
+type limiter struct {
+	config limitConfig
+
+	mu      sync.Mutex
+	swept   time.Time
+	buckets map[string]*limitBucket
+}
+
+type limitBucket struct {
+	tokens   float64
+	last     time.Time
+	inFlight int
+}
+
+func newLimiter(config limitConfig) *limiter {
+	if config.burst == 0 {
+		config.burst = int(math.Max(1, math.Ceil(config.rate)))
+	}
+	return &limiter{
+		config:  config,
+		swept:   time.Now(),
+		buckets: make(map[string]*limitBucket),
+	}
+}
+
+// matches reports whether the limit applies to the method
+func (l *limiter) matches(method string) bool {
+	if l.config.method == "" {
+		return true
+	}
+	return method == l.config.method || method[strings.LastIndex(method, "/")+1:] == l.config.method
+}
+
+// acquire takes a token and an in-flight slot of the group, the returned
+// function releases the slot. When the call isn't allowed, it returns how long
+// to wait before retrying instead.
+func (l *limiter) acquire(group string, now time.Time) (func(), time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	b, ok := l.buckets[group]
+	if !ok {
+		b = &limitBucket{tokens: float64(l.config.burst), last: now}
+		l.buckets[group] = b
+	}
+	if l.config.rate > 0 {
+		b.tokens = math.Min(float64(l.config.burst), b.tokens+now.Sub(b.last).Seconds()*l.config.rate)
+		b.last = now
+		if b.tokens < 1 {
+			return nil, time.Duration((1 - b.tokens) / l.config.rate * float64(time.Second))
+		}
+	}
+	if l.config.inFlight > 0 && b.inFlight >= l.config.inFlight {
+		return nil, inFlightRetryAfter
+	}
+	if l.config.rate > 0 {
+		b.tokens--
+	}
+	b.inFlight++
+	return func() {
+		l.mu.Lock()
+		b.inFlight--
+		l.mu.Unlock()
+	}, 0
+}
+
+// sweep removes the buckets which are back to their initial state, so the
+// groups of past clients don't pile up
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < limiterSweepInterval {
+		return
+	}
+	l.swept = now
+	for group, b := range l.buckets {
+		full := l.config.rate == 0 || b.tokens+now.Sub(b.last).Seconds()*l.config.rate >= float64(l.config.burst)
+		if full && b.inFlight == 0 {
+			delete(l.buckets, group)
+		}
+	}
+}
+
+// limitGroup returns the group of the call for the limit, callers without a
+// principal are grouped by their address
+func limitGroup(ctx context.Context, by, method string) string {
+	switch by {
+	case "method":
+		return method
+	case "principal":
+		if p := principalFrom(ctx); p != nil {
+			return "principal:" + p.id
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		addr := p.Addr.String()
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			addr = host
+		}
+		return "peer:" + addr
+	}
+	return ""
+}
+
+// limit acquires every limit which applies to the call, it returns the
+// function releasing them or the ResourceExhausted error along with the retry
+// hint
+func (s *Service) limit(ctx context.Context, method string) (func(), time.Duration, error) {
+	if strings.HasPrefix(method, healthMethodPrefix) {
+		return func() {}, 0, nil
+	}
+	now := time.Now()
+	var releases []func()
+	release := func() {
+		for _, r := range releases {
+			r()
+		}
+	}
+	for _, l := range s.limits {
+		if !l.matches(method) {
+			continue
+		}
+		r, retryAfter := l.acquire(limitGroup(ctx, l.config.by, method), now)
+		if r == nil {
+			release()
+			err := status.Newf(codes.ResourceExhausted, "%s limit exceeded, retry after %v", l.config, retryAfter.Round(time.Millisecond))
+			return nil, retryAfter, withDetail(err, -1, true).Err()
+		}
+		releases = append(releases, r)
+	}
+	return release, 0, nil
+}
+
+// retryAfterTrailer is the trailer with the seconds to wait before retrying a
+// call rejected by a limit
+func retryAfterTrailer(retryAfter time.Duration) metadata.MD {
+	return metadata.Pairs("retry-after", fmt.Sprintf("%.3f", retryAfter.Seconds()))
+}
+
+// limitUnary rejects the unary calls over the limits
+func (s *Service) limitUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	release, retryAfter, err := s.limit(ctx, info.FullMethod)
+	if err != nil {
+		grpc.SetTrailer(ctx, retryAfterTrailer(retryAfter))
+		return nil, err
+	}
+	defer release()
+	return handler(ctx, req)
+}
+
+// limitStream rejects the streams over the limits, a stream holds its
+// in-flight slots until it ends
+func (s *Service) limitStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	release, retryAfter, err := s.limit(ss.Context(), info.FullMethod)
+	if err != nil {
+		ss.SetTrailer(retryAfterTrailer(retryAfter))
+		return err
+	}
+	defer release()
+	return handler(srv, ss)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	context "context"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/yndc/kvrpc/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// defaultScanLimit is the number of results returned by a scan without a limit
+const defaultScanLimit = 1000
+
+// reservedEnd is the first key after the reserved keyspace
+var reservedEnd = func() []byte {
+	end := append([]byte{}, reservedPrefix...)
+	end[len(end)-1]++
+	return end
+}()
+
+// scan iterates over the entries of the keyspace which match the request and
+// calls fn for each of them, val is only set when withValues is true. It
+// returns the key to continue from when the limit is reached.
+func (d *database) scan(ctx context.Context, ks keyspace, in *pb.ScanRequest, withValues bool, fn func(key, val []byte)) ([]byte, error) {
+	if ks.reserved(in.Prefix) {
+		return nil, status.Error(codes.InvalidArgument, "prefix is inside the reserved keyspace")
+	}
+	f, err := compileFilter(in.Filter)
+	if err != nil {
+		return nil, err
+	}
+	limit := int(in.Limit)
+	if limit == 0 {
+		limit = defaultScanLimit
+	}
+
+	prefix := ks.key(in.Prefix)
+	start := ks.key(in.Start)
+	if bytes.Compare(start, prefix) < 0 {
+		start = prefix
+	}
+	readValues := withValues || f.needsValue()
+	if !d.iterable(prefix) {
+		return nil, nil
+	}
+
+	var next []byte
+	err = d.view(ctx, func(txn *badger.Txn) error {
+		opt := badger.DefaultIteratorOptions
+		opt.Prefix = prefix
+		opt.PrefetchValues = readValues
+		it := txn.NewIterator(opt)
+		defer it.Close()
+
+		count := 0
+		it.Seek(start)
+		for it.Valid() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			item := it.Item()
+			if ks.reserved(item.Key()) {
+				it.Seek(reservedEnd)
+				continue
+			}
+			key := item.KeyCopy(nil)[len(ks.prefix):]
+			if count == limit {
+				next = key
+				return nil
+			}
+
+			if f.matchKey(key, uint64(item.ValueSize())) {
+				var val []byte
+				if readValues {
+					val, err = item.ValueCopy(nil)
+					if err != nil {
+						return err
+					}
+				}
+				if f.matchValue(val) {
+					if !withValues {
+						val = nil
+					}
+					fn(key, val)
+					count++
+				}
+			}
+			it.Next()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+// Scan returns the key-value pairs matching the given prefix and filter
+func (s *Service) Scan(ctx context.Context, in *pb.ScanRequest) (*pb.ScanResponse, error) {
+	if err := s.authorizePrefix(ctx, pb.Operation_READ, in.Database, in.Namespace, in.Prefix); err != nil {
+		return nil, err
+	}
+	d, ks, release, err := s.keyspace(in.Database, in.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	values := make([]*pb.KeyValue, 0)
+	next, err := d.scan(ctx, ks, in, true, func(key, val []byte) {
+		values = append(values, &pb.KeyValue{Key: key, Value: val})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.ScanResponse{
+		Values: values,
+		Next:   next,
+	}, nil
+}
+
+// List returns the keys matching the given prefix and filter
+func (s *Service) List(ctx context.Context, in *pb.ScanRequest) (*pb.ListResponse, error) {
+	if err := s.authorizePrefix(ctx, pb.Operation_READ, in.Database, in.Namespace, in.Prefix); err != nil {
+		return nil, err
+	}
+	d, ks, release, err := s.keyspace(in.Database, in.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	keys := make([][]byte, 0)
+	next, err := d.scan(ctx, ks, in, false, func(key, val []byte) {
+		keys = append(keys, key)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.ListResponse{
+		Keys: keys,
+		Next: next,
+	}, nil
+}
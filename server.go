@@ -2,6 +2,8 @@ package main
 
 import (
 	context "context"
+	"sync"
+	"time"
 
 	"github.com/dgraph-io/badger/v3"
 	"github.com/rs/zerolog"
@@ -12,7 +14,35 @@ import (
 // Service is gRPC service for KVRPC
 type Service struct {
 	pb.UnimplementedKVRPCServer
-	db *badger.DB
+	logger  badger.Logger
+	badger  badgerOptions
+	started time.Time
+
+	// readOnly opens every database read-only, the mutating requests are
+	// rejected and nothing is written by the server itself
+	readOnly bool
+
+	// requestRetention is how long the responses of requests with an id are
+	// kept to detect retries
+	requestRetention time.Duration
+
+	requestLimits requestLimits
+
+	// deadlines are the default deadlines of the calls by method
+	deadlines map[string]time.Duration
+
+	tokens *tokenStore
+	jwt    *jwtVerifier
+	acl    *accessControl
+	limits []*limiter
+
+	metrics *metrics
+	tracer  *tracer
+	audit   *auditLog
+	slow    *slowLog
+
+	dbsMu sync.RWMutex
+	dbs   map[string]*database
 }
 
 type zeroLogger struct {
@@ -43,72 +73,242 @@ func (l *zeroLogger) Debugf(str string, args ...interface{}) {
 
 // NewService creates a new KVRPC service
 func NewService(config *config) *Service {
-	opt := badger.DefaultOptions(config.path)
+	var logger badger.Logger
 	switch config.loglevel {
 	case "debug":
-		opt = opt.WithLogger(newZeroLogger(zerolog.DebugLevel))
+		logger = newZeroLogger(zerolog.DebugLevel)
 	case "info":
-		opt = opt.WithLogger(newZeroLogger(zerolog.InfoLevel))
+		logger = newZeroLogger(zerolog.InfoLevel)
 	case "warn":
-		opt = opt.WithLogger(newZeroLogger(zerolog.WarnLevel))
+		logger = newZeroLogger(zerolog.WarnLevel)
 	case "error":
-		opt = opt.WithLogger(newZeroLogger(zerolog.ErrorLevel))
+		logger = newZeroLogger(zerolog.ErrorLevel)
 	default:
-		opt = opt.WithLogger(newZeroLogger(zerolog.InfoLevel))
-	}
-	db, err := badger.Open(opt)
-	if err != nil {
-		log.Fatal().Err(err).Msg("error opening database directory")
+		logger = newZeroLogger(zerolog.InfoLevel)
 	}
 
-	return &Service{
-		db: db,
+	s := &Service{
+		logger:           logger,
+		badger:           config.badger,
+		started:          time.Now(),
+		readOnly:         config.readOnly,
+		tokens:           newTokenStore(config.tokens),
+		acl:              newAccessControl(),
+		metrics:          newMetrics(),
+		requestRetention: config.requestRetention,
+		requestLimits: requestLimits{
+			maxBatchKeys: config.maxBatchKeys,
+			maxKeySize:   config.maxKeySize,
+			maxValueSize: config.maxValueSize,
+		},
+		deadlines: config.deadlines,
+		dbs:       make(map[string]*database),
+	}
+	if s.requestRetention <= 0 {
+		s.requestRetention = defaultRequestRetention
+	}
+	if s.requestLimits.maxKeySize <= 0 {
+		s.requestLimits.maxKeySize = badgerMaxKeySize
+	}
+	if s.requestLimits.maxValueSize <= 0 {
+		s.requestLimits.maxValueSize = config.badger.valueLogFileSize
+	}
+	for _, l := range config.limits {
+		s.limits = append(s.limits, newLimiter(l))
+	}
+	if config.traceFile != "" || config.traceEndpoint != "" {
+		t, err := newTracer(config.traceFile, config.traceEndpoint, config.traceSampleRatio)
+		if err != nil {
+			log.Fatal().Err(err).Msg("error opening the trace file")
+		}
+		s.tracer = t
+	}
+	if config.audit.file != "" {
+		a, err := newAuditLog(config.audit)
+		if err != nil {
+			log.Fatal().Err(err).Msg("error opening the audit log")
+		}
+		s.audit = a
+	}
+	if config.slowThreshold > 0 {
+		s.slow = newSlowLog(config.slowThreshold, config.slowBufferSize)
+	}
+	if config.jwt.jwks != "" {
+		verifier, err := newJWTVerifier(config.jwt)
+		if err != nil {
+			log.Fatal().Err(err).Msg("error loading the JWKS")
+		}
+		s.jwt = verifier
+	}
+	main := databaseConfig{
+		name:     defaultDatabase,
+		path:     config.path,
+		inMemory: config.inMemory,
+	}
+	if config.inMemory {
+		main.path = ""
+	}
+	databases := append([]databaseConfig{main}, config.databases...)
+	for _, c := range databases {
+		if err := s.addDatabase(c); err != nil {
+			s.Close()
+			log.Fatal().Err(err).Str("database", c.name).Msg("error opening database")
+		}
+	}
+	if err := s.tokens.load(s.dbs[defaultDatabase]); err != nil {
+		s.Close()
+		log.Fatal().Err(err).Msg("error loading the revoked tokens")
+	}
+	if err := s.acl.load(s.dbs[defaultDatabase]); err != nil {
+		s.Close()
+		log.Fatal().Err(err).Msg("error loading the access rules")
 	}
+	return s
 }
 
-// Close the service
-func (s *Service) Close() {
-	s.db.Close()
+// Close the service along with all of the databases, the memtables of the
+// persistent ones are flushed to disk. It returns the last error of closing
+// them.
+func (s *Service) Close() error {
+	s.dbsMu.Lock()
+	defer s.dbsMu.Unlock()
+	var failed error
+	for name, d := range s.dbs {
+		if err := d.close(); err != nil {
+			log.Error().Err(err).Str("database", name).Msg("error closing database")
+			failed = err
+		}
+	}
+	if s.tracer != nil {
+		if err := s.tracer.close(); err != nil {
+			log.Error().Err(err).Msg("error closing the trace file")
+		}
+		s.tracer = nil
+	}
+	if s.audit != nil {
+		if err := s.audit.close(); err != nil {
+			log.Error().Err(err).Msg("error closing the audit log")
+		}
+	}
+	return failed
 }
 
 // Set writes the given key-value data into the disk
 func (s *Service) Set(ctx context.Context, in *pb.SetRequest) (*pb.SetResponse, error) {
-	results := make([]bool, len(in.Values))
+	keys := make([][]byte, len(in.Values))
+	for i, v := range in.Values {
+		keys[i] = v.Key
+	}
+	if err := s.authorizeKeys(ctx, pb.Operation_WRITE, in.Database, in.Namespace, keys); err != nil {
+		return nil, err
+	}
+	d, ks, release, err := s.keyspace(in.Database, in.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if err := d.writable(); err != nil {
+		return nil, err
+	}
+	if err := s.requestLimits.checkBatch(len(in.Values)); err != nil {
+		return nil, err
+	}
+	q := d.namespaceQuota(in.Namespace)
+	for i, v := range in.Values {
+		if err := s.requestLimits.checkKey(ks, i, v.Key); err != nil {
+			return nil, err
+		}
+		if err := s.requestLimits.checkValue(i, v.Value); err != nil {
+			return nil, err
+		}
+		if q != nil {
+			if err := q.checkValue(i, len(v.Value)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	res := &pb.SetResponse{
+		Result: make([]bool, len(in.Values)),
+	}
 
-	err := s.db.Update(func(txn *badger.Txn) error {
+	request, err := newIdempotencyKey(ctx, "Set", in.Namespace, in.RequestId, in)
+	if err != nil {
+		return nil, err
+	}
+	// reserved is the change of the usage reserved by the last run of the
+	// transaction, a run only happens again when the previous one didn't
+	// commit
+	var reserved usage
+	applied, err := s.idempotent(ctx, d, request, res, func(txn *badger.Txn) error {
+		if q != nil {
+			q.release(reserved)
+			reserved = usage{}
+		}
+		var change usage
 		values := in.Values
 		for i, v := range values {
-			err := txn.Set(v.Key, v.Value)
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if q != nil {
+				if err := change.track(txn, ks, v.Key, int64(len(v.Value))); err != nil {
+					return &keyError{i, err}
+				}
+			}
+			err := txn.Set(ks.key(v.Key), v.Value)
 			if err != nil {
+				return &keyError{i, err}
+			}
+			res.Result[i] = true
+		}
+		if q != nil {
+			if err := q.reserve(change); err != nil {
 				return err
 			}
-			results[i] = true
+			reserved = change
 		}
 		return nil
 	})
 
+	if q != nil && (err != nil || !applied) {
+		q.release(reserved)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	return &pb.SetResponse{
-		Result: results,
-	}, nil
+	return res, nil
 }
 
 // Get retrieves the data specified by the given keys
 func (s *Service) Get(ctx context.Context, in *pb.GetRequest) (*pb.GetResponse, error) {
+	if err := s.authorizeKeys(ctx, pb.Operation_READ, in.Database, in.Namespace, in.Keys); err != nil {
+		return nil, err
+	}
+	d, ks, release, err := s.keyspace(in.Database, in.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if err := s.requestLimits.checkKeys(ks, in.Keys); err != nil {
+		return nil, err
+	}
+
 	results := make([]*pb.ValueResult, len(in.Keys))
-	err := s.db.View(func(txn *badger.Txn) error {
+	err = d.view(ctx, func(txn *badger.Txn) error {
 		for i, k := range in.Keys {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 			results[i] = &pb.ValueResult{}
-			item, err := txn.Get(k)
+			item, err := txn.Get(ks.key(k))
 			if err != nil {
 				if err == badger.ErrKeyNotFound {
 					results[i].Exists = false
 					continue
 				}
-				return err
+				return &keyError{i, err}
 			}
 			err = item.Value(func(val []byte) error {
 				dst := make([]byte, len(val))
@@ -119,7 +319,7 @@ func (s *Service) Get(ctx context.Context, in *pb.GetRequest) (*pb.GetResponse,
 				return nil
 			})
 			if err != nil {
-				return err
+				return &keyError{i, err}
 			}
 		}
 		return nil
@@ -136,14 +336,43 @@ func (s *Service) Get(ctx context.Context, in *pb.GetRequest) (*pb.GetResponse,
 
 // Del deletes the data with the given keys
 func (s *Service) Del(ctx context.Context, in *pb.DelRequest) (*pb.Empty, error) {
+	if err := s.authorizeKeys(ctx, pb.Operation_DELETE, in.Database, in.Namespace, in.Keys); err != nil {
+		return nil, err
+	}
+	d, ks, release, err := s.keyspace(in.Database, in.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if err := d.writable(); err != nil {
+		return nil, err
+	}
+	if err := s.requestLimits.checkKeys(ks, in.Keys); err != nil {
+		return nil, err
+	}
 
-	err := s.db.Update(func(txn *badger.Txn) error {
+	request, err := newIdempotencyKey(ctx, "Del", in.Namespace, in.RequestId, in)
+	if err != nil {
+		return nil, err
+	}
+	q := d.namespaceQuota(in.Namespace)
+	var change usage
+	applied, err := s.idempotent(ctx, d, request, &pb.Empty{}, func(txn *badger.Txn) error {
+		change = usage{}
 		keys := in.GetKeys()
-		for _, k := range keys {
-			err := txn.Delete(k)
-			if err != nil {
+		for i, k := range keys {
+			if err := ctx.Err(); err != nil {
 				return err
 			}
+			if q != nil {
+				if err := change.track(txn, ks, k, -1); err != nil {
+					return &keyError{i, err}
+				}
+			}
+			err := txn.Delete(ks.key(k))
+			if err != nil {
+				return &keyError{i, err}
+			}
 		}
 		return nil
 	})
@@ -151,6 +380,9 @@ func (s *Service) Del(ctx context.Context, in *pb.DelRequest) (*pb.Empty, error)
 	if err != nil {
 		return nil, err
 	}
+	if q != nil && applied {
+		q.add(change)
+	}
 
 	return &pb.Empty{}, nil
 }
@@ -3,19 +3,38 @@ package main
 import (
 	"context"
 	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/dgraph-io/badger/v3"
+	"github.com/yndc/kvrpc/kvrpc"
 	"github.com/yndc/kvrpc/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestSetGet(t *testing.T) {
 	service := setup()
-	defer clean()
 	defer service.Close()
 
 	setResponse, err := service.Set(context.Background(), &pb.SetRequest{
@@ -70,6 +89,1310 @@ func TestSetGet(t *testing.T) {
 	}
 }
 
+func TestBuckets(t *testing.T) {
+	service := setup()
+	defer service.Close()
+
+	ctx := context.Background()
+	for _, name := range []string{"one", "two"} {
+		if _, err := service.CreateBucket(ctx, &pb.CreateBucketRequest{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := service.CreateBucket(ctx, &pb.CreateBucketRequest{Name: "one"}); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("expected AlreadyExists, got %v", err)
+	}
+	if _, err := service.CreateBucket(ctx, &pb.CreateBucketRequest{Name: "a/b"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument, got %v", err)
+	}
+
+	// the same key is isolated between namespaces
+	for _, ns := range []string{"", "one", "two"} {
+		_, err := service.Set(ctx, &pb.SetRequest{
+			Namespace: ns,
+			Values:    []*pb.KeyValue{{Key: []byte("key"), Value: []byte("value-" + ns)}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, ns := range []string{"", "one", "two"} {
+		res, err := service.Get(ctx, &pb.GetRequest{Namespace: ns, Keys: [][]byte{[]byte("key")}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if eq(res.Values[0].Value, []byte("value-"+ns)) == false {
+			t.Errorf("unexpected value %q in namespace %q", res.Values[0].Value, ns)
+		}
+	}
+
+	if _, err := service.Get(ctx, &pb.GetRequest{Namespace: "three", Keys: [][]byte{[]byte("key")}}); status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound, got %v", err)
+	}
+	if _, err := service.Get(ctx, &pb.GetRequest{Keys: [][]byte{reservedKey("bucket", "one")}}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument, got %v", err)
+	}
+
+	if _, err := service.DropBucket(ctx, &pb.DropBucketRequest{Name: "one"}); err != nil {
+		t.Fatal(err)
+	}
+	list, err := service.ListBuckets(ctx, &pb.ListBucketsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Buckets) != 1 || list.Buckets[0].Name != "two" {
+		t.Errorf("unexpected buckets %v", list.Buckets)
+	}
+
+	// recreating a dropped bucket starts empty
+	if _, err := service.CreateBucket(ctx, &pb.CreateBucketRequest{Name: "one"}); err != nil {
+		t.Fatal(err)
+	}
+	res, err := service.Get(ctx, &pb.GetRequest{Namespace: "one", Keys: [][]byte{[]byte("key")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Values[0].Exists {
+		t.Error("dropped bucket still has data")
+	}
+
+	// dropping waits for the writes in flight into the bucket
+	d, ks, release, err := service.keyspace("", "two")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dropped := make(chan error, 1)
+	go func() {
+		_, err := service.DropBucket(ctx, &pb.DropBucketRequest{Name: "two"})
+		dropped <- err
+	}()
+	select {
+	case err := <-dropped:
+		t.Fatalf("expected the drop to wait for the write, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	// meanwhile the other buckets are served and the dropping one can't be
+	// created again
+	if _, err := service.Get(ctx, &pb.GetRequest{Namespace: "one", Keys: [][]byte{[]byte("key")}}); err != nil {
+		t.Fatal(err)
+	}
+	if list, err := service.ListBuckets(ctx, &pb.ListBucketsRequest{}); err != nil || len(list.Buckets) != 1 || list.Buckets[0].Name != "one" {
+		t.Errorf("expected the dropping bucket not to be listed, got %v %v", list, err)
+	}
+	if _, err := service.CreateBucket(ctx, &pb.CreateBucketRequest{Name: "two"}); status.Code(err) != codes.Unavailable {
+		t.Errorf("expected Unavailable creating a dropping bucket, got %v", err)
+	}
+	if err := d.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(ks.key([]byte("late")), []byte("value"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if err := <-dropped; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.Set(ctx, &pb.SetRequest{Namespace: "two", Values: []*pb.KeyValue{{Key: []byte("key"), Value: []byte("v")}}}); status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound writing into the dropped bucket, got %v", err)
+	}
+	if _, err := service.CreateBucket(ctx, &pb.CreateBucketRequest{Name: "two"}); err != nil {
+		t.Fatal(err)
+	}
+	res, err = service.Get(ctx, &pb.GetRequest{Namespace: "two", Keys: [][]byte{[]byte("late")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Values[0].Exists {
+		t.Error("the write in flight survived the drop")
+	}
+}
+
+func TestDatabases(t *testing.T) {
+	service := setup()
+	defer service.Close()
+
+	ctx := context.Background()
+	_, err := service.OpenDatabase(ctx, &pb.OpenDatabaseRequest{Name: "cache", InMemory: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.OpenDatabase(ctx, &pb.OpenDatabaseRequest{Name: "cache", InMemory: true}); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("expected AlreadyExists, got %v", err)
+	}
+
+	_, err = service.Set(ctx, &pb.SetRequest{
+		Database: "cache",
+		Values:   []*pb.KeyValue{{Key: []byte("key"), Value: []byte("cached")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := service.Get(ctx, &pb.GetRequest{Keys: [][]byte{[]byte("key")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Values[0].Exists {
+		t.Error("value leaked into the default database")
+	}
+	res, err = service.Get(ctx, &pb.GetRequest{Database: "cache", Keys: [][]byte{[]byte("key")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eq(res.Values[0].Value, []byte("cached")) == false {
+		t.Errorf("unexpected value %q", res.Values[0].Value)
+	}
+
+	list, err := service.ListDatabases(ctx, &pb.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Databases) != 2 || list.Databases[0].Name != "cache" || list.Databases[1].Name != defaultDatabase {
+		t.Errorf("unexpected databases %v", list.Databases)
+	}
+
+	if _, err := service.CloseDatabase(ctx, &pb.CloseDatabaseRequest{Name: defaultDatabase}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition, got %v", err)
+	}
+	if _, err := service.CloseDatabase(ctx, &pb.CloseDatabaseRequest{Name: "cache"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.Get(ctx, &pb.GetRequest{Database: "cache", Keys: [][]byte{[]byte("key")}}); status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound, got %v", err)
+	}
+}
+
+func TestScanFilter(t *testing.T) {
+	service := setup()
+	defer service.Close()
+
+	ctx := context.Background()
+	_, err := service.Set(ctx, &pb.SetRequest{
+		Values: []*pb.KeyValue{
+			{Key: []byte("user/1"), Value: []byte(`{"name":"alice","role":{"admin":true}}`)},
+			{Key: []byte("user/2"), Value: []byte(`{"name":"bob","role":{"admin":false}}`)},
+			{Key: []byte("user/3"), Value: []byte(`{"name":"carol","role":{"admin":true}}`)},
+			{Key: []byte("group/1"), Value: []byte("admins")},
+			{Key: []byte("group/22"), Value: []byte("everyone")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.CreateBucket(ctx, &pb.CreateBucketRequest{Name: "hidden"}); err != nil {
+		t.Fatal(err)
+	}
+
+	list := func(in *pb.ScanRequest) []string {
+		res, err := service.List(ctx, in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := make([]string, len(res.Keys))
+		for i, k := range res.Keys {
+			keys[i] = string(k)
+		}
+		return keys
+	}
+	cases := []struct {
+		in       *pb.ScanRequest
+		expected string
+	}{
+		{&pb.ScanRequest{}, "group/1 group/22 user/1 user/2 user/3"},
+		{&pb.ScanRequest{Prefix: []byte("user/")}, "user/1 user/2 user/3"},
+		{&pb.ScanRequest{Filter: &pb.Filter{KeyRegex: `/\d{2}$`}}, "group/22"},
+		{&pb.ScanRequest{Filter: &pb.Filter{KeyGlob: "*/?"}}, "group/1 user/1 user/2 user/3"},
+		{&pb.ScanRequest{Filter: &pb.Filter{ValuePrefix: []byte("admin")}}, "group/1"},
+		{&pb.ScanRequest{Filter: &pb.Filter{ValueContains: []byte("bo")}}, "user/2"},
+		{&pb.ScanRequest{Filter: &pb.Filter{JsonField: &pb.JSONFieldFilter{Path: "role.admin", Value: "true"}}}, "user/1 user/3"},
+		{&pb.ScanRequest{Filter: &pb.Filter{MinSize: 7, MaxSize: 8}}, "group/22"},
+	}
+	for _, c := range cases {
+		if keys := strings.Join(list(c.in), " "); keys != c.expected {
+			t.Errorf("%v: expected %q, got %q", c.in, c.expected, keys)
+		}
+	}
+
+	// paging
+	res, err := service.Scan(ctx, &pb.ScanRequest{Prefix: []byte("user/"), Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Values) != 2 || string(res.Next) != "user/3" {
+		t.Errorf("unexpected first page %v", res)
+	}
+	res, err = service.Scan(ctx, &pb.ScanRequest{Prefix: []byte("user/"), Start: res.Next, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Values) != 1 || string(res.Values[0].Key) != "user/3" || res.Next != nil {
+		t.Errorf("unexpected second page %v", res)
+	}
+
+	if _, err := service.List(ctx, &pb.ScanRequest{Filter: &pb.Filter{KeyRegex: "("}}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument, got %v", err)
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	service := setup()
+	defer service.Close()
+
+	ctx := context.Background()
+	values := make([]*pb.KeyValue, 0)
+	for i := 0; i < 1000; i++ {
+		counter := make([]byte, 8)
+		binary.BigEndian.PutUint64(counter, uint64(i-500))
+		values = append(values, &pb.KeyValue{
+			Key:   []byte(fmt.Sprintf("counter/%d/%d", i%10, i)),
+			Value: counter,
+		})
+	}
+	values = append(values, &pb.KeyValue{Key: []byte("counter/other"), Value: []byte("not a counter")})
+	values = append(values, &pb.KeyValue{Key: []byte("unrelated"), Value: []byte("x")})
+	if _, err := service.Set(ctx, &pb.SetRequest{Values: values}); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := service.Aggregate(ctx, &pb.AggregateRequest{
+		Prefix: []byte("counter/"),
+		Reducers: []pb.Reducer{
+			pb.Reducer_COUNT,
+			pb.Reducer_SUM_INT64,
+			pb.Reducer_MIN_MAX_INT64,
+			pb.Reducer_SIZE_HISTOGRAM,
+			pb.Reducer_DISTINCT_PREFIX,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Count != 1001 || res.Int64Count != 1000 {
+		t.Errorf("unexpected counts %d %d", res.Count, res.Int64Count)
+	}
+	if res.Sum != -500 || res.Min != -500 || res.Max != 499 {
+		t.Errorf("unexpected sum %d min %d max %d", res.Sum, res.Min, res.Max)
+	}
+	if res.DistinctPrefixes != 11 {
+		t.Errorf("expected 11 distinct prefixes, got %d", res.DistinctPrefixes)
+	}
+	histogram := make(map[uint64]uint64)
+	for _, b := range res.SizeHistogram {
+		histogram[b.Le] = b.Count
+	}
+	if histogram[15] != 1001 {
+		t.Errorf("unexpected histogram %v", res.SizeHistogram)
+	}
+
+	res, err = service.Aggregate(ctx, &pb.AggregateRequest{
+		Filter:   &pb.Filter{KeyGlob: "counter/3/*"},
+		Reducers: []pb.Reducer{pb.Reducer_SUM_INT64},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the sum of 10k+3-500 for k in 0..99
+	if res.Count != 100 || res.Sum != -200 {
+		t.Errorf("unexpected filtered count %d sum %d", res.Count, res.Sum)
+	}
+}
+
+func TestIdempotency(t *testing.T) {
+	service := setup()
+	defer service.Close()
+
+	ctx := context.Background()
+	set := func(value string) {
+		_, err := service.Set(ctx, &pb.SetRequest{
+			RequestId: "set-1",
+			Values:    []*pb.KeyValue{{Key: []byte("key"), Value: []byte(value)}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func() string {
+		res, err := service.Get(ctx, &pb.GetRequest{Keys: [][]byte{[]byte("key")}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(res.Values[0].Value)
+	}
+
+	set("first")
+	if _, err := service.Set(ctx, &pb.SetRequest{Values: []*pb.KeyValue{{Key: []byte("key"), Value: []byte("second")}}}); err != nil {
+		t.Fatal(err)
+	}
+	// the retry must not overwrite the second write
+	set("first")
+	if v := get(); v != "second" {
+		t.Errorf("expected the retry to be ignored, got %q", v)
+	}
+
+	// reusing the id for a different request is rejected
+	_, err := service.Set(ctx, &pb.SetRequest{RequestId: "set-1", Values: []*pb.KeyValue{{Key: []byte("key"), Value: []byte("third")}}})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition reusing the request id, got %v", err)
+	}
+
+	// the ids are scoped to the namespace and the principal
+	for _, name := range []string{"a", "b"} {
+		if _, err := service.CreateBucket(ctx, &pb.CreateBucketRequest{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range []struct {
+		ctx       context.Context
+		namespace string
+	}{
+		{ctx, "a"},
+		{ctx, "b"},
+		{withPrincipal(ctx, &principal{id: "other", admin: true}), "b"},
+	} {
+		exists := func() bool {
+			res, err := service.Get(c.ctx, &pb.GetRequest{Namespace: c.namespace, Keys: [][]byte{[]byte("key")}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return res.Values[0].Exists
+		}
+		if _, err := service.Set(c.ctx, &pb.SetRequest{Namespace: c.namespace, RequestId: "r1", Values: []*pb.KeyValue{{Key: []byte("key"), Value: []byte("v")}}}); err != nil {
+			t.Fatal(err)
+		}
+		if !exists() {
+			t.Errorf("expected the write into %q to be applied", c.namespace)
+		}
+		if _, err := service.Del(c.ctx, &pb.DelRequest{Namespace: c.namespace, RequestId: "r1", Keys: [][]byte{[]byte("key")}}); err != nil {
+			t.Fatal(err)
+		}
+		if exists() {
+			t.Errorf("expected the delete from %q to be applied", c.namespace)
+		}
+	}
+
+	// concurrent duplicates are applied once
+	wg := sync.WaitGroup{}
+	created := make(chan int64, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bucket, err := service.CreateBucket(ctx, &pb.CreateBucketRequest{Name: "once", RequestId: "create-1"})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			created <- bucket.CreatedAt
+		}()
+	}
+	wg.Wait()
+	close(created)
+	if len(created) != 10 {
+		t.Errorf("expected all the duplicates to succeed, got %d", len(created))
+	}
+}
+
+func TestPing(t *testing.T) {
+	service := setup()
+	defer service.Close()
+
+	res, err := service.Ping(context.Background(), &pb.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Response != "pong" || res.Version != version {
+		t.Errorf("unexpected response %v", res)
+	}
+	if res.Persistent {
+		t.Errorf("expected an in-memory server to not be persistent")
+	}
+	if len(res.Databases) != 1 || !res.Databases[0].Database.InMemory || res.Databases[0].Database.Path != "" {
+		t.Errorf("unexpected databases %v", res.Databases)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	service := setup()
+	defer service.Close()
+
+	checker := newHealthChecker(service, time.Minute)
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	pb.RegisterKVRPCServer(server, service)
+	healthpb.RegisterHealthServer(server, checker.server)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	client, err := kvrpc.NewClient(kvrpc.ClientOptions{
+		Address: "bufconn",
+		DialOptions: []grpc.DialOption{
+			grpc.WithInsecure(),
+			grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+				return listener.Dial()
+			}),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	checker.drain()
+	for _, name := range []string{"", kvrpcServiceName} {
+		res, err := checker.server.Check(ctx, &healthpb.HealthCheckRequest{Service: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+			t.Errorf("expected %q to be not serving after draining, got %v", name, res.Status)
+		}
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if err := client.WaitReady(ctx); err == nil {
+		t.Error("expected WaitReady to time out while draining")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	run := func(hold, timeout time.Duration) (int, error) {
+		service := setup()
+		checker := newHealthChecker(service, time.Minute)
+		started := make(chan struct{})
+		listener := bufconn.Listen(1 << 20)
+		server := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			close(started)
+			select {
+			case <-time.After(hold):
+			case <-ctx.Done():
+			}
+			return handler(ctx, req)
+		}))
+		pb.RegisterKVRPCServer(server, service)
+		healthpb.RegisterHealthServer(server, checker)
+		go server.Serve(listener)
+		dialOptions := []grpc.DialOption{
+			grpc.WithInsecure(),
+			grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+				return listener.Dial()
+			}),
+		}
+		client, err := kvrpc.NewClient(kvrpc.ClientOptions{
+			Address:     "bufconn",
+			DialOptions: dialOptions,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		// a health watch doesn't hold the shutdown, it sees the server
+		// stop serving and is then ended
+		conn, err := grpc.Dial("bufconn", dialOptions...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		watch, err := healthpb.NewHealthClient(conn).Watch(context.Background(), &healthpb.HealthCheckRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res, err := watch.Recv(); err != nil || res.Status != healthpb.HealthCheckResponse_SERVING {
+			t.Fatalf("expected the server to be serving, got %v %v", res, err)
+		}
+		watched := make(chan error)
+		go func() {
+			for {
+				res, err := watch.Recv()
+				if err != nil {
+					watched <- err
+					return
+				}
+				if res.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+					watched <- fmt.Errorf("expected the server not to be serving, got %v", res.Status)
+					return
+				}
+			}
+		}()
+
+		result := make(chan error)
+		go func() {
+			_, err := client.Set(context.Background(), []*pb.KeyValue{{Key: []byte("a"), Value: []byte("1")}})
+			result <- err
+		}()
+		<-started
+		code := shutdown(server, checker, service, 0, timeout)
+		if _, _, err := service.database(defaultDatabase); status.Code(err) != codes.Unavailable {
+			t.Errorf("expected the database to be closed, got %v", err)
+		}
+		if err := <-watched; status.Code(err) != codes.Unavailable {
+			t.Errorf("expected the health watch to be ended, got %v", err)
+		}
+		return code, <-result
+	}
+
+	// the calls in flight are waited for
+	if code, err := run(100*time.Millisecond, time.Minute); code != 0 || err != nil {
+		t.Errorf("expected a clean shutdown, got %d %v", code, err)
+	}
+	// and cancelled past the timeout
+	if code, err := run(time.Minute, 100*time.Millisecond); code != 1 || err == nil {
+		t.Errorf("expected the shutdown to time out, got %d %v", code, err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvrpc-read-only-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	config := defaultConfig()
+	config.path = dir
+	config.loglevel = "error"
+	service := NewService(config)
+	_, err = service.Set(ctx, &pb.SetRequest{Values: []*pb.KeyValue{{Key: []byte("key"), Value: []byte("value")}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.Close()
+
+	config.readOnly = true
+	service = NewService(config)
+	defer service.Close()
+
+	res, err := service.Get(ctx, &pb.GetRequest{Keys: [][]byte{[]byte("key")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eq(res.Values[0].Value, []byte("value")) == false {
+		t.Errorf("unexpected value %q", res.Values[0].Value)
+	}
+
+	for prefix, expected := range map[string]int{"": 1, "k": 1, "x": 0} {
+		scan, err := service.Scan(ctx, &pb.ScanRequest{Prefix: []byte(prefix)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(scan.Values) != expected {
+			t.Errorf("expected %d values with prefix %q, got %v", expected, prefix, scan.Values)
+		}
+	}
+
+	_, err = service.Set(ctx, &pb.SetRequest{Values: []*pb.KeyValue{{Key: []byte("key"), Value: []byte("other")}}})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected Set to fail with FailedPrecondition, got %v", err)
+	}
+	if _, err := service.Del(ctx, &pb.DelRequest{Keys: [][]byte{[]byte("key")}}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected Del to fail with FailedPrecondition, got %v", err)
+	}
+	if _, err := service.CreateBucket(ctx, &pb.CreateBucketRequest{Name: "users"}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected CreateBucket to fail with FailedPrecondition, got %v", err)
+	}
+
+	ping, err := service.Ping(ctx, &pb.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ping.ReadOnly || !ping.Persistent || !ping.Databases[0].Database.ReadOnly {
+		t.Errorf("unexpected response %v", ping)
+	}
+
+	checker := newHealthChecker(service, time.Minute)
+	health, err := checker.server.Check(ctx, &healthpb.HealthCheckRequest{Service: kvrpcServiceName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if health.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("expected a read-only server to be serving, got %v", health.Status)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvrpc-auth-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hash := func(secret string) string {
+		sum := sha256.Sum256([]byte(secret))
+		return hex.EncodeToString(sum[:])
+	}
+	config := defaultConfig()
+	config.path = dir
+	config.loglevel = "error"
+	config.tokens = []tokenConfig{
+		{id: "root", hash: hash("root-secret"), admin: true},
+		{id: "ci", hash: hash("ci-secret")},
+	}
+	service := NewService(config)
+
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(service.authenticateUnary),
+		grpc.ChainStreamInterceptor(service.authenticateStream),
+	)
+	pb.RegisterKVRPCServer(server, service)
+	healthpb.RegisterHealthServer(server, newHealthChecker(service, time.Minute).server)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	connect := func(token string) *kvrpc.Client {
+		client, err := kvrpc.NewClient(kvrpc.ClientOptions{
+			Address: "bufconn",
+			Token:   token,
+			DialOptions: []grpc.DialOption{
+				grpc.WithInsecure(),
+				grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+					return listener.Dial()
+				}),
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+	ctx := context.Background()
+
+	anonymous := connect("")
+	defer anonymous.Close()
+	if err := anonymous.Ping(ctx); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected Unauthenticated without a token, got %v", err)
+	}
+	if err := anonymous.WaitReady(ctx); err != nil {
+		t.Errorf("expected the health service to be open, got %v", err)
+	}
+	wrong := connect("ci.wrong-secret")
+	defer wrong.Close()
+	if err := wrong.Ping(ctx); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected Unauthenticated with a wrong secret, got %v", err)
+	}
+
+	ci := connect("ci.ci-secret")
+	defer ci.Close()
+	if err := ci.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := ci.RevokeToken(ctx, "root"); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied revoking without an admin token, got %v", err)
+	}
+	root := connect("root.root-secret")
+	defer root.Close()
+	if err := root.RevokeToken(ctx, "ci"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ci.Ping(ctx); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected Unauthenticated with a revoked token, got %v", err)
+	}
+
+	// revocations outlive restarts
+	server.Stop()
+	service.Close()
+	service = NewService(config)
+	defer service.Close()
+	if _, err := service.tokens.authenticate("ci.ci-secret"); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected the revocation to be loaded, got %v", err)
+	}
+}
+
+func TestAccessRules(t *testing.T) {
+	service := setup()
+	defer service.Close()
+
+	admin := withPrincipal(context.Background(), &principal{id: "root", admin: true})
+	user := withPrincipal(context.Background(), &principal{id: "app"})
+	_, err := service.SetAccessRules(admin, &pb.PrincipalRules{
+		Principal: "app",
+		Rules: []*pb.AccessRule{
+			{Prefix: []byte("app/"), Operations: []pb.Operation{pb.Operation_READ, pb.Operation_WRITE}},
+			{Namespace: anyName, Operations: []pb.Operation{pb.Operation_ADMIN}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.SetAccessRules(user, &pb.PrincipalRules{Principal: "app"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied setting rules without an admin token, got %v", err)
+	}
+
+	_, err = service.Set(user, &pb.SetRequest{Values: []*pb.KeyValue{{Key: []byte("app/1"), Value: []byte("a")}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = service.Set(user, &pb.SetRequest{Values: []*pb.KeyValue{
+		{Key: []byte("app/2"), Value: []byte("b")},
+		{Key: []byte("other"), Value: []byte("c")},
+	}})
+	if status.Code(err) != codes.PermissionDenied || !strings.Contains(err.Error(), "key 1") {
+		t.Errorf("expected PermissionDenied for key 1, got %v", err)
+	}
+	if _, err := service.Del(user, &pb.DelRequest{Keys: [][]byte{[]byte("app/1")}}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied deleting without the delete operation, got %v", err)
+	}
+	if _, err := service.Scan(user, &pb.ScanRequest{Prefix: []byte("app/")}); err != nil {
+		t.Errorf("expected the prefix to be readable, got %v", err)
+	}
+	if _, err := service.Scan(user, &pb.ScanRequest{}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied scanning outside of the prefix, got %v", err)
+	}
+	if _, err := service.CreateBucket(user, &pb.CreateBucketRequest{Name: "logs"}); err != nil {
+		t.Errorf("expected the bucket to be created, got %v", err)
+	}
+	if _, err := service.Get(user, &pb.GetRequest{Namespace: "logs", Keys: [][]byte{[]byte("app/1")}}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied reading another namespace, got %v", err)
+	}
+	if _, err := service.OpenDatabase(user, &pb.OpenDatabaseRequest{Name: "cache", InMemory: true}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied opening a database, got %v", err)
+	}
+
+	// the listings only show what the rules of the caller cover
+	if _, err := service.CreateBucket(admin, &pb.CreateBucketRequest{Name: "metrics"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.SetAccessRules(admin, &pb.PrincipalRules{
+		Principal: "reader",
+		Rules:     []*pb.AccessRule{{Namespace: "logs", Operations: []pb.Operation{pb.Operation_READ}}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	reader := withPrincipal(context.Background(), &principal{id: "reader"})
+	nobody := withPrincipal(context.Background(), &principal{id: "nobody"})
+	if buckets, err := service.ListBuckets(reader, &pb.ListBucketsRequest{}); err != nil || len(buckets.Buckets) != 1 || buckets.Buckets[0].Name != "logs" {
+		t.Errorf("expected only the bucket of the rules to be listed, got %v %v", buckets, err)
+	}
+	if buckets, err := service.ListBuckets(user, &pb.ListBucketsRequest{}); err != nil || len(buckets.Buckets) != 2 {
+		t.Errorf("expected every bucket to be listed with a rule for every namespace, got %v %v", buckets, err)
+	}
+	if databases, err := service.ListDatabases(reader, &pb.Empty{}); err != nil || len(databases.Databases) != 1 {
+		t.Errorf("expected the database of the rules to be listed, got %v %v", databases, err)
+	}
+	if buckets, err := service.ListBuckets(nobody, &pb.ListBucketsRequest{}); err != nil || len(buckets.Buckets) != 0 {
+		t.Errorf("expected no buckets to be listed without rules, got %v %v", buckets, err)
+	}
+	if databases, err := service.ListDatabases(nobody, &pb.Empty{}); err != nil || len(databases.Databases) != 0 {
+		t.Errorf("expected no databases to be listed without rules, got %v %v", databases, err)
+	}
+	if info, err := service.Ping(nobody, &pb.Empty{}); err != nil || len(info.Databases) != 0 {
+		t.Errorf("expected no databases to be reported without rules, got %v %v", info, err)
+	}
+
+	list, err := service.ListAccessRules(admin, &pb.ListAccessRulesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Principals) != 2 || list.Principals[0].Principal != "app" || len(list.Principals[0].Rules) != 2 {
+		t.Errorf("unexpected rules %v", list.Principals)
+	}
+	if _, err := service.SetAccessRules(admin, &pb.PrincipalRules{Principal: "app"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.Get(user, &pb.GetRequest{Keys: [][]byte{[]byte("app/1")}}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied once the rules are removed, got %v", err)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	service := setup()
+	defer service.Close()
+
+	ctx := withPrincipal(context.Background(), &principal{id: "root", admin: true})
+	if _, err := service.CreateBucket(ctx, &pb.CreateBucketRequest{Name: "team"}); err != nil {
+		t.Fatal(err)
+	}
+	set := func(key, value string) error {
+		_, err := service.Set(ctx, &pb.SetRequest{
+			Namespace: "team",
+			Values:    []*pb.KeyValue{{Key: []byte(key), Value: []byte(value)}},
+		})
+		return err
+	}
+	if err := set("a", "1234"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the existing keys are counted when the quota is set
+	_, err := service.SetQuota(ctx, &pb.Quota{Namespace: "team", MaxBytes: 20, MaxKeys: 3, MaxValueSize: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := set("b", "12345678"); err != nil {
+		t.Fatal(err)
+	}
+	if err := set("c", "123456789"); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected ResourceExhausted over the value size, got %v", err)
+	}
+	if err := set("c", "12345678"); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected ResourceExhausted over the bytes, got %v", err)
+	}
+	// replacing a value only counts the difference
+	if err := set("b", "12"); err != nil {
+		t.Fatal(err)
+	}
+	if err := set("c", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := set("d", ""); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected ResourceExhausted over the keys, got %v", err)
+	}
+	if _, err := service.Del(ctx, &pb.DelRequest{Namespace: "team", Keys: [][]byte{[]byte("a"), []byte("x")}}); err != nil {
+		t.Fatal(err)
+	}
+	// other namespaces aren't limited
+	if _, err := service.Set(ctx, &pb.SetRequest{Values: []*pb.KeyValue{{Key: []byte("big"), Value: make([]byte, 64)}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := service.GetUsage(ctx, &pb.GetUsageRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Usage) != 1 || res.Usage[0].Quota.Namespace != "team" || res.Usage[0].Bytes != 5 || res.Usage[0].Keys != 2 {
+		t.Errorf("unexpected usage %v", res.Usage)
+	}
+}
+
+func TestQuotaConcurrent(t *testing.T) {
+	service := setup()
+	defer service.Close()
+
+	ctx := context.Background()
+	if _, err := service.CreateBucket(ctx, &pb.CreateBucketRequest{Name: "team"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.SetQuota(ctx, &pb.Quota{Namespace: "team", MaxKeys: 1000}); err != nil {
+		t.Fatal(err)
+	}
+
+	// concurrent writes can't exceed the quota together
+	var wg sync.WaitGroup
+	var written int64
+	for w := 0; w < 64; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			values := make([]*pb.KeyValue, 100)
+			for i := range values {
+				values[i] = &pb.KeyValue{Key: []byte(fmt.Sprintf("%d/%d", w, i)), Value: []byte("v")}
+			}
+			_, err := service.Set(ctx, &pb.SetRequest{Namespace: "team", Values: values})
+			switch status.Code(err) {
+			case codes.OK:
+				atomic.AddInt64(&written, int64(len(values)))
+			case codes.ResourceExhausted:
+			default:
+				t.Error(err)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	res, err := service.GetUsage(ctx, &pb.GetUsageRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := res.Usage[0].Keys; keys > 1000 || keys != written {
+		t.Errorf("expected the usage to stay within the quota and match the %d keys written, got %d", written, keys)
+	}
+	if written != 1000 {
+		t.Errorf("expected the writes to fill the quota, got %d keys", written)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	config := defaultConfig()
+	config.inMemory = true
+	config.loglevel = "error"
+	config.limits = []limitConfig{{by: "peer", method: "Ping", rate: 1, burst: 2}}
+	service := NewService(config)
+	defer service.Close()
+
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(grpc.ChainUnaryInterceptor(service.limitUnary))
+	pb.RegisterKVRPCServer(server, service)
+	go server.Serve(listener)
+	defer server.Stop()
+	client, err := kvrpc.NewClient(kvrpc.ClientOptions{
+		Address: "bufconn",
+		DialOptions: []grpc.DialOption{
+			grpc.WithInsecure(),
+			grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+				return listener.Dial()
+			}),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := client.Ping(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var trailer metadata.MD
+	if err := client.Ping(ctx, grpc.Trailer(&trailer)); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected ResourceExhausted over the burst, got %v", err)
+	}
+	if retryAfter, err := strconv.ParseFloat(strings.Join(trailer.Get("retry-after"), ""), 64); err != nil || retryAfter <= 0 || retryAfter > 1 {
+		t.Errorf("unexpected retry-after %v", trailer.Get("retry-after"))
+	}
+	if _, err := client.Get(ctx, [][]byte{[]byte("key")}); err != nil {
+		t.Errorf("expected the other methods to be unlimited, got %v", err)
+	}
+
+	// the in-flight slots are taken until released
+	l := newLimiter(limitConfig{by: "principal", inFlight: 1})
+	now := time.Now()
+	release, _ := l.acquire("a", now)
+	if r, retryAfter := l.acquire("a", now); r != nil || retryAfter != inFlightRetryAfter {
+		t.Error("expected the second call in flight to be rejected")
+	}
+	if r, _ := l.acquire("b", now); r == nil {
+		t.Error("expected the groups to be limited separately")
+	}
+	release()
+	if r, _ := l.acquire("a", now); r == nil {
+		t.Error("expected the released slot to be available")
+	}
+}
+
+func TestRequestLimits(t *testing.T) {
+	config := defaultConfig()
+	config.inMemory = true
+	config.loglevel = "error"
+	config.maxBatchKeys = 3
+	config.maxKeySize = 8
+	config.maxValueSize = 16
+	service := NewService(config)
+	defer service.Close()
+
+	ctx := context.Background()
+	keys := func(keys ...string) [][]byte {
+		b := make([][]byte, len(keys))
+		for i, k := range keys {
+			b[i] = []byte(k)
+		}
+		return b
+	}
+	cases := []struct {
+		call     func() error
+		expected string
+	}{
+		{func() error {
+			_, err := service.Get(ctx, &pb.GetRequest{Keys: keys("a", "b", "c", "d")})
+			return err
+		}, "request has 4 keys, over the limit of 3"},
+		{func() error {
+			_, err := service.Del(ctx, &pb.DelRequest{Keys: keys("a", "123456789")})
+			return err
+		}, "key 1 is 9 bytes, over the limit of 8"},
+		{func() error {
+			_, err := service.Get(ctx, &pb.GetRequest{Keys: keys("a", "")})
+			return err
+		}, "key 1 is empty"},
+		{func() error {
+			_, err := service.Set(ctx, &pb.SetRequest{Values: []*pb.KeyValue{
+				{Key: []byte("a"), Value: []byte("1")},
+				{Key: []byte("b"), Value: make([]byte, 17)},
+			}})
+			return err
+		}, "value 1 is 17 bytes, over the limit of 16"},
+	}
+	for _, c := range cases {
+		err := c.call()
+		if status.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), c.expected) {
+			t.Errorf("expected InvalidArgument %q, got %v", c.expected, err)
+		}
+	}
+	// nothing of a rejected batch is written
+	res, err := service.Get(ctx, &pb.GetRequest{Keys: keys("a")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Values[0].Exists {
+		t.Error("expected the rejected batch not to be written")
+	}
+
+	// the namespace prefix counts towards the key size limit of Badger
+	limits := requestLimits{maxKeySize: badgerMaxKeySize}
+	ks := namespaceKeyspace("team")
+	if err := limits.checkKey(ks, 0, make([]byte, badgerMaxKeySize)); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected the namespaced key to be rejected, got %v", err)
+	}
+	if err := limits.checkKey(ks, 0, make([]byte, badgerMaxKeySize-len(ks.prefix))); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	config := defaultConfig()
+	config.inMemory = true
+	config.loglevel = "error"
+	config.badger.memTableSize = 1 << 20
+	config.badger.valueThreshold = 1 << 10
+	service := NewService(config)
+	defer service.Close()
+
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(grpc.ChainUnaryInterceptor(service.errorsUnary))
+	pb.RegisterKVRPCServer(server, service)
+	go server.Serve(listener)
+	defer server.Stop()
+	client, err := kvrpc.NewClient(kvrpc.ClientOptions{
+		Address: "bufconn",
+		DialOptions: []grpc.DialOption{
+			grpc.WithInsecure(),
+			grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+				return listener.Dial()
+			}),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ctx := context.Background()
+
+	// a transaction over the batch size of the memtable
+	values := make([]*pb.KeyValue, 1000)
+	for i := range values {
+		values[i] = &pb.KeyValue{Key: []byte(strconv.Itoa(i)), Value: make([]byte, 512)}
+	}
+	_, err = client.Set(ctx, values)
+	if !kvrpc.IsOverLimit(err) || kvrpc.IsRetryable(err) || kvrpc.KeyIndex(err) <= 0 {
+		t.Errorf("expected a ResourceExhausted error naming the key, got %v at %d", err, kvrpc.KeyIndex(err))
+	}
+
+	_, err = client.Get(ctx, [][]byte{[]byte("a"), nil})
+	if e, ok := kvrpc.AsError(err); !ok || e.Code != codes.InvalidArgument || e.KeyIndex != 1 || e.Retryable {
+		t.Errorf("expected an InvalidArgument error for key 1, got %+v", e)
+	}
+	if _, err := client.Database("missing").Get(ctx, [][]byte{[]byte("a")}); !kvrpc.IsNotFound(err) || kvrpc.KeyIndex(err) != -1 {
+		t.Errorf("expected NotFound without a key, got %v", err)
+	}
+
+	cases := map[error]codes.Code{
+		badger.ErrConflict:                          codes.Aborted,
+		badger.ErrDBClosed:                          codes.Unavailable,
+		badger.ErrEmptyKey:                          codes.InvalidArgument,
+		&keyError{3, badger.ErrTxnTooBig}:           codes.ResourceExhausted,
+		fmt.Errorf("disk: %w", io.ErrUnexpectedEOF): codes.Internal,
+	}
+	for cause, code := range cases {
+		e, _ := kvrpc.AsError(statusError(cause))
+		if e == nil || e.Code != code || e.Retryable != (code == codes.Aborted || code == codes.Unavailable) {
+			t.Errorf("expected %v to map into %v, got %+v", cause, code, e)
+		}
+	}
+}
+
+// cancelAfter is a context which is cancelled once Err was called the given
+// number of times
+type cancelAfter struct {
+	context.Context
+	cancel func()
+	calls  int64
+}
+
+func newCancelAfter(calls int64) *cancelAfter {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &cancelAfter{Context: ctx, cancel: cancel, calls: calls}
+}
+
+func (c *cancelAfter) Err() error {
+	if atomic.AddInt64(&c.calls, -1) < 0 {
+		c.cancel()
+	}
+	return c.Context.Err()
+}
+
+func TestCancellation(t *testing.T) {
+	config := defaultConfig()
+	config.inMemory = true
+	config.loglevel = "error"
+	config.deadlines = map[string]time.Duration{"Scan": time.Minute, anyName: time.Second}
+	service := NewService(config)
+	defer service.Close()
+
+	// a cancelled batch is aborted without writing anything
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	values := make([]*pb.KeyValue, 1000)
+	for i := range values {
+		values[i] = &pb.KeyValue{Key: []byte(strconv.Itoa(i)), Value: []byte("v")}
+	}
+	if _, err := service.Set(ctx, &pb.SetRequest{Values: values}); status.Code(statusError(err)) != codes.Canceled {
+		t.Errorf("expected Canceled, got %v", err)
+	}
+	res, err := service.Get(context.Background(), &pb.GetRequest{Keys: [][]byte{[]byte("0")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Values[0].Exists {
+		t.Error("expected the cancelled batch not to be written")
+	}
+	if _, err := service.Set(context.Background(), &pb.SetRequest{Values: values}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.Scan(ctx, &pb.ScanRequest{}); status.Code(statusError(err)) != codes.Canceled {
+		t.Errorf("expected the scan to be cancelled, got %v", err)
+	}
+	// an aggregation cancelled while it runs stops instead of walking the
+	// rest of the keys
+	running := newCancelAfter(100)
+	if _, err := service.Aggregate(running, &pb.AggregateRequest{Reducers: []pb.Reducer{pb.Reducer_COUNT}}); status.Code(statusError(err)) != codes.Canceled {
+		t.Errorf("expected the aggregation to be cancelled, got %v", err)
+	}
+	if n := -atomic.LoadInt64(&running.calls); n > 2*aggregateThreads {
+		t.Errorf("expected the aggregation to stop once cancelled, it checked %d more keys", n)
+	}
+
+	// the default deadlines only apply to the calls without one
+	deadline := func(ctx context.Context, method string) time.Duration {
+		var remaining time.Duration
+		info := &grpc.UnaryServerInfo{FullMethod: "/pb.KVRPC/" + method}
+		service.deadlineUnary(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			if d, ok := ctx.Deadline(); ok {
+				remaining = time.Until(d)
+			}
+			return nil, nil
+		})
+		return remaining
+	}
+	if d := deadline(context.Background(), "Scan"); d <= time.Second || d > time.Minute {
+		t.Errorf("expected the deadline of Scan, got %v", d)
+	}
+	if d := deadline(context.Background(), "Get"); d <= 0 || d > time.Second {
+		t.Errorf("expected the default deadline, got %v", d)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	if d := deadline(ctx, "Get"); d <= time.Minute {
+		t.Errorf("expected the deadline of the caller to be kept, got %v", d)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	service := setup()
+	defer service.Close()
+
+	call := func(method string, req interface{}, handler grpc.UnaryHandler) {
+		info := &grpc.UnaryServerInfo{FullMethod: "/pb.KVRPC/" + method}
+		service.metricsUnary(context.Background(), req, info, handler)
+	}
+	set := &pb.SetRequest{Values: []*pb.KeyValue{{Key: []byte("a"), Value: []byte("1")}, {Key: []byte("b"), Value: []byte("2")}}}
+	call("Set", set, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return service.Set(ctx, req.(*pb.SetRequest))
+	})
+	call("Get", &pb.GetRequest{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.InvalidArgument, "invalid")
+	})
+
+	server := httptest.NewServer(service.metricsHandler())
+	defer server.Close()
+	res, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`kvrpc_requests_total{method="Set",code="OK"} 1`,
+		`kvrpc_requests_total{method="Get",code="InvalidArgument"} 1`,
+		`kvrpc_request_duration_seconds_count{method="Set"} 1`,
+		`kvrpc_batch_keys_bucket{method="Set",le="1"} 0`,
+		`kvrpc_batch_keys_bucket{method="Set",le="10"} 1`,
+		fmt.Sprintf(`kvrpc_received_bytes_total{method="Set"} %d`, proto.Size(set)),
+		"kvrpc_audit_write_failures_total 0",
+		`kvrpc_database_lsm_size_bytes{database="default"}`,
+		"# TYPE badger_v3_puts_total counter",
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("expected the metrics to contain %q", expected)
+		}
+	}
+}
+
+func TestSlowRequests(t *testing.T) {
+	config := defaultConfig()
+	config.inMemory = true
+	config.loglevel = "error"
+	config.slowThreshold = time.Nanosecond
+	config.slowBufferSize = 2
+	service := NewService(config)
+	defer service.Close()
+
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}})
+	call := func(method string, req interface{}, handler grpc.UnaryHandler) {
+		info := &grpc.UnaryServerInfo{FullMethod: "/pb.KVRPC/" + method}
+		service.slowUnary(ctx, req, info, handler)
+	}
+	set := &pb.SetRequest{Values: []*pb.KeyValue{{Key: []byte("a"), Value: []byte("1")}, {Key: []byte("b"), Value: []byte("2")}}}
+	call("Set", set, func(ctx context.Context, req interface{}) (interface{}, error) {
+		if stats := callStatsFrom(ctx); stats == nil {
+			t.Error("expected the stats of the call to be collected")
+		}
+		return service.Set(ctx, req.(*pb.SetRequest))
+	})
+	call("Get", &pb.GetRequest{Keys: [][]byte{[]byte("a")}}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return service.Get(ctx, req.(*pb.GetRequest))
+	})
+	call("Del", &pb.DelRequest{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.InvalidArgument, "invalid")
+	})
+
+	if _, err := service.ListSlowRequests(withPrincipal(context.Background(), &principal{id: "app"}), &pb.Empty{}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected listing the slow requests to require an admin, got %v", err)
+	}
+	if _, err := service.ListSlowRequests(withPrincipal(context.Background(), &principal{id: "admin", admin: true}), &pb.Empty{}); err != nil {
+		t.Fatal(err)
+	}
+	// every caller is an admin without authentication
+	res, err := service.ListSlowRequests(context.Background(), &pb.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Requests) != 2 {
+		t.Fatalf("expected the 2 most recent slow requests, got %v", res.Requests)
+	}
+	del, get := res.Requests[0], res.Requests[1]
+	if del.Method != "/pb.KVRPC/Del" || del.Code != "InvalidArgument" || del.Peer != "10.0.0.1:5000" {
+		t.Errorf("unexpected slow request %v", del)
+	}
+	if get.Method != "/pb.KVRPC/Get" || get.Code != "OK" || get.Keys != 1 || get.Bytes <= 0 || get.StartedAt == 0 {
+		t.Errorf("unexpected slow request %v", get)
+	}
+
+	// the time spent on the transaction is split into waiting and applying
+	d, release, err := service.database("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	statsCtx, stats := withCallStats(context.Background())
+	if err := d.update(statsCtx, func(txn *badger.Txn) error {
+		return txn.Set([]byte("c"), []byte("3"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if stats.wait <= 0 || stats.txn <= 0 {
+		t.Errorf("expected the wait and the transaction to be timed, got %+v", stats)
+	}
+}
+
 func TestConcurrentOverlap(t *testing.T) {
 	// Make an array of sequential numbers with their MD5 hash as a result
 	size := 1000
@@ -89,7 +1412,6 @@ func TestConcurrentOverlap(t *testing.T) {
 	fmt.Printf("created sample data for %d ms\n", sw().Milliseconds())
 
 	service := setup()
-	defer clean()
 	defer service.Close()
 
 	// run the writers simultaneously (with overlapping keys too)
@@ -212,7 +1534,6 @@ func TestConcurrent(t *testing.T) {
 	fmt.Printf("concurrent: created sample data for %d ms\n", sw().Milliseconds())
 
 	service := setup()
-	defer clean()
 	defer service.Close()
 
 	// run the writers simultaneously (with overlapping keys)
@@ -285,7 +1606,6 @@ func TestBatched(t *testing.T) {
 	fmt.Printf("batched: created sample data for %d ms\n", sw().Milliseconds())
 
 	service := setup()
-	defer clean()
 	defer service.Close()
 
 	// run the writer
@@ -331,20 +1651,14 @@ func TestBatched(t *testing.T) {
 }
 
 func setup() *Service {
-	clean()
-	config := &config{
-		port:     3000,
-		path:     "./test_db",
-		loglevel: "error",
-	}
+	config := defaultConfig()
+	config.port = 3000
+	config.inMemory = true
+	config.loglevel = "error"
 
 	return NewService(config)
 }
 
-func clean() {
-	os.RemoveAll("./test_db")
-}
-
 func eq(one []byte, two []byte) bool {
 	if len(one) != len(two) {
 		return false
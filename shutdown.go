@@ -0,0 +1,46 @@
+package main
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+)
+
+// defaultShutdownTimeout is how long the calls in flight are waited for on
+// shutdown when it isn't configured
+const defaultShutdownTimeout = 30 * time.Second
+
+// shutdown drains the server and closes the databases, it returns the exit
+// code. The health checks report not serving first and the server keeps
+// serving for the drain delay, so that the load balancers move away before the
+// new calls are refused. The health Watch streams are then ended and the calls
+// in flight are waited for up to the timeout and cancelled past it.
+func shutdown(server *grpc.Server, health *healthChecker, service *Service, drainDelay, timeout time.Duration) int {
+	code := 0
+	health.drain()
+	if drainDelay > 0 {
+		log.Info().Dur("delay", drainDelay).Msg("draining")
+		time.Sleep(drainDelay)
+	}
+
+	health.endWatches()
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		log.Warn().Dur("timeout", timeout).Msg("calls still in flight after the shutdown timeout, cancelling them")
+		server.Stop()
+		<-stopped
+		code = 1
+	}
+
+	if err := service.Close(); err != nil {
+		code = 1
+	}
+	return code
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	context "context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/yndc/kvrpc/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// callStats is the time a call spent on its Badger transactions, which are
+// run one after the other
+type callStats struct {
+	// wait is the time spent opening the transactions and waiting for their
+	// commits
+	wait time.Duration
+	// txn is the time spent inside the transactions
+	txn time.Duration
+}
+
+type callStatsKey struct{}
+
+func withCallStats(ctx context.Context) (context.Context, *callStats) {
+	stats := &callStats{}
+	return context.WithValue(ctx, callStatsKey{}, stats), stats
+}
+
+// callStatsFrom returns the stats of the call, nil when they aren't collected
+func callStatsFrom(ctx context.Context) *callStats {
+	stats, _ := ctx.Value(callStatsKey{}).(*callStats)
+	return stats
+}
+
+func (c *callStats) add(wait, txn time.Duration) {
+	if c == nil {
+		return
+	}
+	c.wait += wait
+	c.txn += txn
+}
+
+// slowLog logs the calls slower than the threshold and keeps the most recent
+// of them in a ring buffer
+type slowLog struct {
+	threshold time.Duration
+
+	mu       sync.Mutex
+	requests []*pb.SlowRequest
+	next     int
+	full     bool
+}
+
+func newSlowLog(threshold time.Duration, size int) *slowLog {
+	return &slowLog{
+		threshold: threshold,
+		requests:  make([]*pb.SlowRequest, size),
+	}
+}
+
+func (l *slowLog) add(r *pb.SlowRequest) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.requests) == 0 {
+		return
+	}
+	l.requests[l.next] = r
+	l.next = (l.next + 1) % len(l.requests)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// recent returns the kept requests, newest first
+func (l *slowLog) recent() []*pb.SlowRequest {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := l.next
+	if l.full {
+		n = len(l.requests)
+	}
+	requests := make([]*pb.SlowRequest, 0, n)
+	for i := 1; i <= n; i++ {
+		requests = append(requests, l.requests[(l.next-i+len(l.requests))%len(l.requests)])
+	}
+	return requests
+}
+
+// slowUnary logs the calls slower than the threshold along with the time
+// spent on their Badger transactions
+func (s *Service) slowUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if s.slow == nil {
+		return handler(ctx, req)
+	}
+	ctx, stats := withCallStats(ctx)
+	start := time.Now()
+	res, err := handler(ctx, req)
+	elapsed := time.Since(start)
+	if elapsed < s.slow.threshold {
+		return res, err
+	}
+
+	r := &pb.SlowRequest{
+		StartedAt:  start.UnixNano() / int64(time.Millisecond),
+		Method:     info.FullMethod,
+		Code:       status.Convert(statusError(err)).Code().String(),
+		Bytes:      int64(messageSize(req)),
+		Duration:   elapsed.Microseconds(),
+		BadgerWait: stats.wait.Microseconds(),
+		BadgerTxn:  stats.txn.Microseconds(),
+	}
+	if n, ok := batchSize(req); ok {
+		r.Keys = int32(n)
+	}
+	if err == nil {
+		r.Bytes += int64(messageSize(res))
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		r.Peer = p.Addr.String()
+	}
+	s.slow.add(r)
+	log.Warn().
+		Str("method", r.Method).
+		Str("code", r.Code).
+		Int32("keys", r.Keys).
+		Int64("bytes", r.Bytes).
+		Dur("duration", elapsed).
+		Dur("badger_wait", stats.wait).
+		Dur("badger_txn", stats.txn).
+		Str("peer", r.Peer).
+		Msg("slow request")
+	return res, err
+}
+
+// ListSlowRequests returns the most recent calls slower than the threshold
+func (s *Service) ListSlowRequests(ctx context.Context, in *pb.Empty) (*pb.ListSlowRequestsResponse, error) {
+	if err := requireAdmin(ctx, "listing the slow requests"); err != nil {
+		return nil, err
+	}
+	res := &pb.ListSlowRequestsResponse{}
+	if s.slow != nil {
+		res.Requests = s.slow.recent()
+	}
+	return res, nil
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	context "context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// traceparentHeader is the metadata key of the W3C trace context
+const traceparentHeader = "traceparent"
+
+// traceFlushInterval is how often the finished spans are exported
+const traceFlushInterval = time.Second
+
+// traceQueueSize is the number of finished spans waiting to be exported, the
+// spans finished while the queue is full are dropped
+const traceQueueSize = 4096
+
+// traceExportTimeout bounds the exports to the collector
+const traceExportTimeout = 10 * time.Second
+
+// span kinds of OTLP
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+)
+
+// traceContext is the trace context propagated in the traceparent metadata
+type traceContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+// parseTraceparent parses a traceparent of the version 00, the later versions
+// are parsed as 00 as the spec requires
+func parseTraceparent(value string) (traceContext, bool) {
+	var t traceContext
+	parts := strings.Split(value, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return t, false
+	}
+	traceID, err1 := hex.DecodeString(parts[1])
+	spanID, err2 := hex.DecodeString(parts[2])
+	flags, err3 := strconv.ParseUint(parts[3], 16, 8)
+	if err1 != nil || err2 != nil || err3 != nil || len(traceID) != 16 || len(spanID) != 8 || len(parts[3]) != 2 {
+		return t, false
+	}
+	copy(t.traceID[:], traceID)
+	copy(t.spanID[:], spanID)
+	if t.traceID == ([16]byte{}) || t.spanID == ([8]byte{}) {
+		return t, false
+	}
+	t.sampled = flags&1 == 1
+	return t, true
+}
+
+func (t traceContext) String() string {
+	flags := 0
+	if t.sampled {
+		flags = 1
+	}
+	return fmt.Sprintf("00-%x-%x-%02x", t.traceID, t.spanID, flags)
+}
+
+// span is a timed operation of a trace, the methods of a nil span do nothing
+// so the operations can be traced whether tracing is enabled or not
+type span struct {
+	tracer   *tracer
+	context  traceContext
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+
+	mu         sync.Mutex
+	end        time.Time
+	attributes map[string]interface{}
+	code       codes.Code
+	message    string
+}
+
+type spanKey struct{}
+
+func withSpan(ctx context.Context, s *span) context.Context {
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+func spanFrom(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// startSpan starts a child of the span of ctx, it returns a nil span when
+// the call isn't traced
+func startSpan(ctx context.Context, name string) (context.Context, *span) {
+	parent := spanFrom(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	s := parent.tracer.newSpan(name, spanKindInternal, parent.context, true)
+	return withSpan(ctx, s), s
+}
+
+func (s *span) setAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attributes[key] = value
+	s.mu.Unlock()
+}
+
+// finish ends the span with the status of err and queues it for the export
+// when it's sampled
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.end = time.Now()
+	if err != nil {
+		st := status.Convert(err)
+		s.code, s.message = st.Code(), st.Message()
+	}
+	s.mu.Unlock()
+	if !s.context.sampled {
+		return
+	}
+	select {
+	case s.tracer.queue <- s:
+	default:
+	}
+}
+
+// spanExporter sends the finished spans to where they're collected
+type spanExporter interface {
+	export(body []byte) error
+	close() error
+}
+
+// tracer records the spans of the calls and exports them in batches as OTLP
+// JSON, either appended to a file one batch per line or posted to the
+// traces endpoint of an OTLP/HTTP collector
+type tracer struct {
+	ratio    float64
+	exporter spanExporter
+	queue    chan *span
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+func newTracer(file, endpoint string, ratio float64) (*tracer, error) {
+	t := &tracer{
+		ratio:   ratio,
+		queue:   make(chan *span, traceQueueSize),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if file != "" {
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		t.exporter = &fileExporter{file: f}
+	} else {
+		t.exporter = &otlpExporter{
+			endpoint: endpoint,
+			client:   &http.Client{Timeout: traceExportTimeout},
+		}
+	}
+	go t.run()
+	return t, nil
+}
+
+func (t *tracer) newSpan(name string, kind int, parent traceContext, hasParent bool) *span {
+	s := &span{
+		tracer:     t,
+		name:       name,
+		kind:       kind,
+		start:      time.Now(),
+		attributes: make(map[string]interface{}),
+	}
+	if hasParent {
+		s.context.traceID = parent.traceID
+		s.context.sampled = parent.sampled
+		s.parentID = parent.spanID
+	} else {
+		rand.Read(s.context.traceID[:])
+		s.context.sampled = mathrand.Float64() < t.ratio
+	}
+	rand.Read(s.context.spanID[:])
+	return s
+}
+
+// startServer starts the span of a call, it continues the trace of the
+// traceparent metadata when there's a valid one
+func (t *tracer) startServer(ctx context.Context, name string) (context.Context, *span) {
+	var parent traceContext
+	ok := false
+	if md, found := metadata.FromIncomingContext(ctx); found {
+		if values := md.Get(traceparentHeader); len(values) > 0 {
+			parent, ok = parseTraceparent(values[0])
+		}
+	}
+	s := t.newSpan(name, spanKindServer, parent, ok)
+	return withSpan(ctx, s), s
+}
+
+// run exports the finished spans until the tracer is closed
+func (t *tracer) run() {
+	defer close(t.stopped)
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+	var batch []*span
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+			continue
+		case <-ticker.C:
+		case <-t.stop:
+			for len(t.queue) > 0 {
+				batch = append(batch, <-t.queue)
+			}
+			t.flush(batch)
+			return
+		}
+		batch = t.flush(batch)
+	}
+}
+
+func (t *tracer) flush(batch []*span) []*span {
+	if len(batch) == 0 {
+		return batch
+	}
+	body, err := json.Marshal(otlpRequest(batch))
+	if err == nil {
+		err = t.exporter.export(body)
+	}
+	if err != nil {
+		log.Warn().Err(err).Int("spans", len(batch)).Msg("failed to export spans")
+	}
+	return batch[:0]
+}
+
+// close exports the spans left and closes the exporter
+func (t *tracer) close() error {
+	close(t.stop)
+	<-t.stopped
+	return t.exporter.close()
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func otlpAttributes(attributes map[string]interface{}) []otlpAttribute {
+	list := make([]otlpAttribute, 0, len(attributes))
+	for key, value := range attributes {
+		var v map[string]interface{}
+		switch value := value.(type) {
+		case int:
+			// 64-bit integers are strings in OTLP JSON
+			v = map[string]interface{}{"intValue": strconv.Itoa(value)}
+		case bool:
+			v = map[string]interface{}{"boolValue": value}
+		default:
+			v = map[string]interface{}{"stringValue": fmt.Sprint(value)}
+		}
+		list = append(list, otlpAttribute{key, v})
+	}
+	return list
+}
+
+// otlpRequest builds the ExportTraceServiceRequest of the spans in the JSON
+// encoding of OTLP
+func otlpRequest(spans []*span) interface{} {
+	list := make([]map[string]interface{}, 0, len(spans))
+	for _, s := range spans {
+		s.mu.Lock()
+		span := map[string]interface{}{
+			"traceId":           hex.EncodeToString(s.context.traceID[:]),
+			"spanId":            hex.EncodeToString(s.context.spanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attributes),
+		}
+		if s.parentID != ([8]byte{}) {
+			span["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		if s.code != codes.OK {
+			span["status"] = map[string]interface{}{"code": 2, "message": s.code.String() + ": " + s.message}
+		}
+		s.mu.Unlock()
+		list = append(list, span)
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]interface{}{"service.name": "kvrpc"}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "kvrpc"},
+				"spans": list,
+			}},
+		}},
+	}
+}
+
+// fileExporter appends the batches to a file, one per line
+type fileExporter struct {
+	file *os.File
+}
+
+func (e *fileExporter) export(body []byte) error {
+	_, err := e.file.Write(append(body, '\n'))
+	return err
+}
+
+func (e *fileExporter) close() error {
+	return e.file.Close()
+}
+
+// otlpExporter posts the batches to an OTLP/HTTP traces endpoint
+type otlpExporter struct {
+	endpoint string
+	client   *http.Client
+}
+
+func (e *otlpExporter) export(body []byte) error {
+	res, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("collector responded with %s: %s", res.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+func (e *otlpExporter) close() error {
+	return nil
+}
+
+// traceUnary records a span for every call which continues the trace of the
+// caller
+func (s *Service) traceUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if s.tracer == nil || strings.HasPrefix(info.FullMethod, healthMethodPrefix) {
+		return handler(ctx, req)
+	}
+	ctx, span := s.tracer.startServer(ctx, strings.TrimPrefix(info.FullMethod, "/"))
+	service, method := "", info.FullMethod
+	if i := strings.LastIndex(info.FullMethod, "/"); i > 0 {
+		service, method = info.FullMethod[1:i], info.FullMethod[i+1:]
+	}
+	span.setAttribute("rpc.system", "grpc")
+	span.setAttribute("rpc.service", service)
+	span.setAttribute("rpc.method", method)
+	if n, ok := batchSize(req); ok {
+		span.setAttribute("kvrpc.batch_keys", n)
+	}
+	res, err := handler(ctx, req)
+	span.setAttribute("rpc.grpc.status_code", int(status.Code(err)))
+	span.finish(err)
+	return res, err
+}
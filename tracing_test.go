@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/yndc/kvrpc/kvrpc"
+	"github.com/yndc/kvrpc/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+type exportedSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Status       *struct {
+		Code int `json:"code"`
+	} `json:"status"`
+}
+
+func decodeSpans(t *testing.T, body []byte) []exportedSpan {
+	var req struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []exportedSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatal(err)
+	}
+	var spans []exportedSpan
+	for _, r := range req.ResourceSpans {
+		for _, s := range r.ScopeSpans {
+			spans = append(spans, s.Spans...)
+		}
+	}
+	return spans
+}
+
+func TestTraceparent(t *testing.T) {
+	valid := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	tc, ok := parseTraceparent(valid)
+	if !ok || !tc.sampled || tc.String() != valid {
+		t.Errorf("expected %q to round trip, got %q", valid, tc)
+	}
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		if _, ok := parseTraceparent(invalid); ok {
+			t.Errorf("expected %q to be invalid", invalid)
+		}
+	}
+	if _, ok := parseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"); !ok {
+		t.Error("expected the fields of later versions to be ignored")
+	}
+}
+
+func TestTracing(t *testing.T) {
+	file, err := ioutil.TempFile("", "kvrpc-traces-*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	config := defaultConfig()
+	config.inMemory = true
+	config.loglevel = "error"
+	config.traceFile = file.Name()
+	config.traceSampleRatio = 0
+	service := NewService(config)
+
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(grpc.ChainUnaryInterceptor(service.traceUnary, service.errorsUnary))
+	pb.RegisterKVRPCServer(server, service)
+	go server.Serve(listener)
+	client, err := kvrpc.NewClient(kvrpc.ClientOptions{
+		Address: "bufconn",
+		DialOptions: []grpc.DialOption{
+			grpc.WithInsecure(),
+			grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+				return listener.Dial()
+			}),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	ctx := kvrpc.WithTraceparent(context.Background(), traceparent)
+	if _, err := client.Set(ctx, []*pb.KeyValue{{Key: []byte("a"), Value: []byte("1")}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get(kvrpc.WithTraceparent(context.Background(), kvrpc.NewTraceparent()), [][]byte{nil}); err == nil {
+		t.Fatal("expected the empty key to be rejected")
+	}
+	// an unsampled trace isn't exported, nor are the calls without a trace
+	// context with a zero sampling ratio
+	unsampled := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"
+	if err := client.Ping(kvrpc.WithTraceparent(context.Background(), unsampled)); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// the client used by a gRPC server continues the trace of the incoming
+	// call
+	incoming := metadata.NewIncomingContext(context.Background(), metadata.Pairs("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"))
+	if err := client.Ping(incoming); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	server.Stop()
+	service.Close()
+
+	f, err := os.Open(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	spans := make(map[string]exportedSpan)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		for _, s := range decodeSpans(t, scanner.Bytes()) {
+			spans[s.Name] = s
+		}
+	}
+	if len(spans) != 5 {
+		t.Errorf("expected the spans of Set, its transaction, Get and Ping, got %v", spans)
+	}
+
+	set := spans["pb.KVRPC/Set"]
+	if set.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || set.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("expected Set to continue the trace of the client, got %+v", set)
+	}
+	for _, name := range []string{"badger.apply", "badger.commit"} {
+		if s := spans[name]; s.TraceID != set.TraceID || s.ParentSpanID != set.SpanID {
+			t.Errorf("expected %s to be a child of Set, got %+v", name, s)
+		}
+	}
+	get := spans["pb.KVRPC/Get"]
+	if get.TraceID == "" || get.TraceID == set.TraceID || get.ParentSpanID == "" {
+		t.Errorf("expected Get to be in the new trace of the caller, got %+v", get)
+	}
+	if get.Status == nil || get.Status.Code != 2 {
+		t.Errorf("expected Get to have an error status, got %+v", get.Status)
+	}
+	ping := spans["pb.KVRPC/Ping"]
+	if ping.TraceID != "0af7651916cd43dd8448eb211c80319c" || ping.ParentSpanID == "" || ping.ParentSpanID == "b7ad6b7169203331" {
+		t.Errorf("expected Ping to continue the incoming trace from a new parent, got %+v", ping)
+	}
+}
+
+func TestTraceEndpoint(t *testing.T) {
+	received := make(chan []byte, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.URL.Path == "/v1/traces" && r.Header.Get("Content-Type") == "application/json" {
+			received <- body
+		}
+	}))
+	defer collector.Close()
+
+	tracer, err := newTracer("", collector.URL+"/v1/traces", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, span := tracer.startServer(context.Background(), "pb.KVRPC/Ping")
+	_, child := startSpan(ctx, "badger.view")
+	child.finish(nil)
+	span.finish(nil)
+	tracer.close()
+
+	spans := decodeSpans(t, <-received)
+	if len(spans) != 2 || spans[0].TraceID != spans[1].TraceID {
+		t.Errorf("expected both spans in a single trace, got %+v", spans)
+	}
+}